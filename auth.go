@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"io/fs"
+	"encoding/json"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/toqueteos/webbrowser"
@@ -21,17 +23,17 @@ func createMapService() *maps.Client {
 	apiKey := os.Getenv("GOOGLE_MAPS_API_KEY")
 	mapService, err := maps.NewClient(maps.WithAPIKey(apiKey))
 	if err != nil {
-		fmt.Println("Unable to create map service", err)
+		logger.Println("Unable to create map service", err)
 		return nil
 	}
 	return mapService
 }
 
-func oauthFromEnv() *oauth2.Config {
+func oauthFromEnv(redirectURL string) *oauth2.Config {
 	clientID := os.Getenv("GOOGLE_CLIENT_ID")
 	clientSecret := os.Getenv("GOOGLE_CLIENT_SECRET")
 	config := &oauth2.Config{
-		RedirectURL:  "https://horned.xyz/api/authcallback",
+		RedirectURL:  redirectURL,
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
 		Scopes:       []string{calendar.CalendarScope},
@@ -40,57 +42,95 @@ func oauthFromEnv() *oauth2.Config {
 	return config
 }
 
-func getService(ctx context.Context, config *oauth2.Config, authCode string) *calendar.Service {
-	token, err := config.Exchange(ctx, authCode)
+func newCalendarService(ctx context.Context, ts oauth2.TokenSource) (*calendar.Service, error) {
+	return calendar.NewService(ctx, option.WithHTTPClient(oauth2.NewClient(ctx, ts)))
+}
+
+// saveToken keeps the token of the command line tools, only the user can read it
+func saveToken(path string, token *oauth2.Token) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(token)
 	if err != nil {
-		fmt.Println("Unable to exchange auth code for token", err)
-		return nil
+		return err
 	}
-	client := config.Client(ctx, token)
-	srv, err := calendar.NewService(ctx, option.WithHTTPClient(client))
+	return os.WriteFile(path, b, 0600)
+}
+
+func loadToken(path string) (*oauth2.Token, error) {
+	b, err := os.ReadFile(path)
 	if err != nil {
-		fmt.Println("Unable to create calendar service", err)
-		return nil
+		return nil, err
 	}
-	return srv
+	token := &oauth2.Token{}
+	if err := json.Unmarshal(b, token); err != nil {
+		return nil, err
+	}
+	return token, nil
 }
 
-func saveAuthCode(authCode string) error {
-	return os.WriteFile("authcode.txt", []byte(authCode), fs.ModePerm)
+// fileTokenSource saves refreshed tokens back into the token file
+type fileTokenSource struct {
+	base oauth2.TokenSource
+	path string
+	last *oauth2.Token
+	mu   sync.Mutex
 }
 
-func loadAuthCode() (string, error) {
-	authCode, err := os.ReadFile("authcode.txt")
+func (f *fileTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := f.base.Token()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return string(authCode), nil
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.last == nil || tok.AccessToken != f.last.AccessToken {
+		f.last = tok
+		if err := saveToken(f.path, tok); err != nil {
+			logger.Println("Unable to save refreshed token", err)
+		}
+	}
+	return tok, nil
+}
+
+func savedTokenSource(ctx context.Context, config *oauth2.Config, path string, token *oauth2.Token) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(token, &fileTokenSource{
+		base: config.TokenSource(ctx, token),
+		path: path,
+		last: token,
+	})
 }
 
 func getAuthCode(config *oauth2.Config, timeout time.Duration, state string) string {
-	ch := make(chan string)
+	ch := make(chan string, 1)
 
-	// Starts the callback server
-	srv := runServer(state, ch)
+	// Starts the callback server on the host of the redirect url
+	u, err := url.Parse(config.RedirectURL)
+	if err != nil {
+		logger.Println("Invalid redirect url", err)
+		return ""
+	}
+	srv := runServer(u.Host, state, ch)
 	defer srv.Shutdown(context.Background())
 
-	// Url that the user goes to
-	authURL := config.AuthCodeURL(state)
-	err := webbrowser.Open(authURL)
+	// Url that the user goes to, offline access gives a refresh token
+	authURL := config.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.ApprovalForce)
+	err = webbrowser.Open(authURL)
 	if err != nil {
-		println("Go to this url:", authURL)
+		logger.Println("Go to this url:", authURL)
 	}
 
 	select {
 	case <-time.After(timeout):
-		fmt.Println("Timeout while waiting for Auth Code")
+		logger.Println("Timeout while waiting for Auth Code")
 		return ""
 	case authCode := <-ch:
 		return authCode
 	}
 }
 
-func runServer(randState string, ch chan string) *http.Server {
+func runServer(addr, randState string, ch chan string) *http.Server {
 	handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		if req.URL.Path == "/favicon.ico" {
 			http.Error(rw, "", http.StatusNotFound)
@@ -107,9 +147,13 @@ func runServer(randState string, ch chan string) *http.Server {
 			return
 		}
 		rw.Write([]byte("Authorized! You can now close this window."))
-		ch <- code
+		// Only the first code is waited for
+		select {
+		case ch <- code:
+		default:
+		}
 	})
-	srv := &http.Server{Addr: "localhost:8080", Handler: handler}
+	srv := &http.Server{Addr: addr, Handler: handler}
 
 	go func() {
 		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+// slotID encodes the window of a slot so it can be booked later
+func slotID(start, end time.Time) string {
+	return strconv.FormatInt(start.Unix(), 10) + "-" + strconv.FormatInt(end.Unix(), 10)
+}
+
+func parseSlotID(id string) (start, end time.Time, err error) {
+	s, e, found := strings.Cut(id, "-")
+	if !found {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid slot id %q", id)
+	}
+	startUnix, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid slot id %q", id)
+	}
+	endUnix, err := strconv.ParseInt(e, 10, 64)
+	if err != nil || endUnix <= startUnix {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid slot id %q", id)
+	}
+	return time.Unix(startUnix, 0), time.Unix(endUnix, 0), nil
+}
+
+// Booking is the body of a /bookSlot request
+type Booking struct {
+	// Either the id of a slot from a previous query or the slot itself
+	SlotID string
+	Slot   *TimeSlot
+	// Length of the event in minutes, the whole slot if zero
+	Duration time.Duration
+	// Calendar the event is created in, the primary calendar if empty
+	CalId string
+	// Calendars that have to be free, only CalId if empty
+	CheckCalIds []string
+	Title       string
+	Description string
+	Location    string
+	// Emails of the people to invite
+	Attendees []string
+	// IANA zone the event is shown in, the server's default if empty
+	TimeZone string
+	// Events that do not block the slot and the buffers kept around
+	// events, like in the query that found it
+	TentativeFree       bool
+	IgnoreAllDay        bool
+	BufferBeforeMinutes int
+	BufferAfterMinutes  int
+}
+
+func (b *Booking) busyOptions() BusyOptions {
+	return BusyOptions{TentativeFree: b.TentativeFree, IgnoreAllDay: b.IgnoreAllDay}
+}
+
+func (b *Booking) buffers() Buffers {
+	return Buffers{Before: b.BufferBeforeMinutes, After: b.BufferAfterMinutes}
+}
+
+// window returns the start and end of the event to create
+func (b *Booking) window() (start, end time.Time, err error) {
+	switch {
+	case b.SlotID != "":
+		start, end, err = parseSlotID(b.SlotID)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	case b.Slot != nil:
+		start, end = b.Slot.Start, b.Slot.End
+		if !end.After(start) {
+			return time.Time{}, time.Time{}, fmt.Errorf("slot ends before it starts")
+		}
+	default:
+		return time.Time{}, time.Time{}, fmt.Errorf("no slot or slot id given")
+	}
+	if b.Duration > 0 {
+		if start.Add(b.Duration).After(end) {
+			return time.Time{}, time.Time{}, fmt.Errorf("the event does not fit in the slot")
+		}
+		end = start.Add(b.Duration)
+	}
+	return start, end, nil
+}
+
+func (b *Booking) validate() error {
+	if b.Title == "" {
+		return fmt.Errorf("no title given")
+	}
+	if b.Duration < 0 {
+		return fmt.Errorf("invalid duration")
+	}
+	for _, a := range b.Attendees {
+		if !strings.Contains(a, "@") {
+			return fmt.Errorf("invalid attendee email %q", a)
+		}
+	}
+	if _, err := loadLocation(b.TimeZone); err != nil {
+		return fmt.Errorf("invalid time zone: %w", err)
+	}
+	if err := b.buffers().validate(); err != nil {
+		return err
+	}
+	_, _, err := b.window()
+	return err
+}
+
+// SlotTakenError is returned when a slot is no longer free
+type SlotTakenError struct {
+	Event Event
+}
+
+func (e *SlotTakenError) Error() string {
+	if e.Event.Summary == "" {
+		return "the slot is no longer free"
+	}
+	return fmt.Sprintf("the slot is no longer free, it overlaps %v", e.Event.Summary)
+}
+
+// checkFree makes sure that no busy event of the calendars overlaps the
+// window, once the events are widened by their buffers like in a search
+func checkFree(ctx context.Context, source EventSource, calIDs []string, start, end time.Time, busy BusyOptions, buffers BufferConfig) error {
+	reach := buffers.widest()
+	for _, id := range calIDs {
+		events, _, err := source.ListEvents(ctx, id, start.Add(-reach), end.Add(reach))
+		if err != nil {
+			return err
+		}
+		for _, e := range buffers.apply(id, events, start.Location()) {
+			if !busy.isBusy(e) {
+				continue
+			}
+			eventStart, eventEnd, ok := eventTimes(e, start.Location())
+			if ok && eventStart.Before(end) && eventEnd.After(start) {
+				return &SlotTakenError{Event: toEvent(e)}
+			}
+		}
+	}
+	return nil
+}
+
+// eventDateTime is the time of an event shown in the zone
+func eventDateTime(t time.Time, loc *time.Location) *calendar.EventDateTime {
+	if loc == time.Local {
+		// Local is not an IANA name, the offset is enough
+		return &calendar.EventDateTime{DateTime: t.In(loc).Format(time.RFC3339)}
+	}
+	return &calendar.EventDateTime{DateTime: t.In(loc).Format(time.RFC3339), TimeZone: loc.String()}
+}
+
+// bookEvent creates the booked event after checking that its window is free
+func bookEvent(ctx context.Context, source EventSource, b Booking, loc *time.Location, buffers BufferConfig) (*calendar.Event, error) {
+	writer, ok := source.(EventWriter)
+	if !ok {
+		return nil, fmt.Errorf("the calendar source cannot create events")
+	}
+	start, end, err := b.window()
+	if err != nil {
+		return nil, err
+	}
+	start, end = start.In(loc), end.In(loc)
+	calID := b.CalId
+	if calID == "" {
+		calID = "primary"
+	}
+	checkIDs := b.CheckCalIds
+	if len(checkIDs) == 0 {
+		checkIDs = []string{calID}
+	}
+	if err := checkFree(ctx, source, checkIDs, start, end, b.busyOptions(), buffers.with(b.buffers())); err != nil {
+		return nil, err
+	}
+
+	e := &calendar.Event{
+		Summary:     b.Title,
+		Description: b.Description,
+		Location:    b.Location,
+		Start:       eventDateTime(start, loc),
+		End:         eventDateTime(end, loc),
+	}
+	for _, a := range b.Attendees {
+		e.Attendees = append(e.Attendees, &calendar.EventAttendee{Email: a})
+	}
+	return writer.InsertEvent(ctx, calID, e)
+}
+
+func bookSlot(ss ServerState) func(rw http.ResponseWriter, req *http.Request) {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(rw, "Only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token, ok := ss.sessionID(req)
+		if !ok {
+			http.Redirect(rw, req, "/login", http.StatusUnauthorized)
+			return
+		}
+		source, ok := ss.sourceFor(token)
+		if !ok {
+			ss.clearCookie(rw, sessionCookie)
+			http.Redirect(rw, req, "/login", http.StatusUnauthorized)
+			return
+		}
+		defer req.Body.Close()
+
+		booking := Booking{}
+		err := json.NewDecoder(req.Body).Decode(&booking)
+		if err != nil {
+			http.Error(rw, "Please provide the booking in the body of the request in the following format: {\"SlotID\": \"1700000000-1700003600\", \"Duration\": 60, \"Title\": \"Site visit\", \"Location\": \"New York\", \"Attendees\": [\"someone@example.com\"]}\n", http.StatusBadRequest)
+			logger.Println("Unable to decode booking")
+			return
+		}
+		// The duration is in minutes
+		booking.Duration *= time.Minute
+
+		err = booking.validate()
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			logger.Println("Invalid booking", err)
+			return
+		}
+		loc, err := loadLocation(firstNonEmpty(booking.TimeZone, ss.defaults.TimeZone))
+		if err != nil {
+			http.Error(rw, "Invalid time zone: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		created, err := bookEvent(req.Context(), source, booking, loc, ss.defaults.Buffers)
+		if err != nil {
+			var taken *SlotTakenError
+			if errors.As(err, &taken) {
+				http.Error(rw, err.Error(), http.StatusConflict)
+				return
+			}
+			http.Error(rw, "Unable to book the slot: "+err.Error(), http.StatusInternalServerError)
+			logger.Println("Unable to book the slot", err)
+			return
+		}
+
+		b, err := json.Marshal(created)
+		if err != nil {
+			http.Error(rw, "Unable to marshal the event", http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write(b)
+	}
+}
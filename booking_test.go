@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBookEventChecksLikeTheSearch(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2030, 1, 7, hour, minute, 0, 0, time.UTC)
+	}
+	tentative := testEvent("Maybe lunch", "", at(12, 0), at(13, 0))
+	tentative.Status = "tentative"
+	tests := []struct {
+		name    string
+		start   time.Time
+		booking Booking
+		buffers BufferConfig
+		taken   bool
+	}{
+		{"free", at(11, 0), Booking{}, BufferConfig{}, false},
+		{"in the buffer after a meeting", at(11, 0), Booking{}, BufferConfig{Buffers: Buffers{After: 15}}, true},
+		{"in a keyword buffer", at(11, 0), Booking{}, BufferConfig{Keywords: map[string]Buffers{"standup": {After: 15}}}, true},
+		{"tentative", at(12, 0), Booking{}, BufferConfig{}, true},
+		{"tentative as free", at(12, 0), Booking{TentativeFree: true}, BufferConfig{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := NewMemorySource()
+			src.Add("primary", "Primary", testEvent("Standup", "", at(10, 0), at(11, 0)), tentative)
+			b := test.booking
+			b.Title = "Visit"
+			b.Slot = &TimeSlot{Start: test.start, End: test.start.Add(30 * time.Minute)}
+			_, err := bookEvent(context.Background(), src, b, time.UTC, test.buffers)
+			var taken *SlotTakenError
+			if errors.As(err, &taken) != test.taken {
+				t.Errorf("got %v, taken %v", err, test.taken)
+			}
+			if err != nil && !test.taken {
+				t.Fatal(err)
+			}
+		})
+	}
+}
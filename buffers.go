@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+// Private extended properties with the minutes a busy event was widened by
+const (
+	bufferBeforeKey = "calendargoBufferBefore"
+	bufferAfterKey  = "calendargoBufferAfter"
+)
+
+// Buffers are the minutes kept free before and after an event, for
+// setting up and wrapping up. They are named like the rest of the config,
+// queries and bookings add theirs with BufferBeforeMinutes and
+// BufferAfterMinutes
+type Buffers struct {
+	Before int `json:"before_minutes"`
+	After  int `json:"after_minutes"`
+}
+
+func (b Buffers) validate() error {
+	if b.Before < 0 || b.After < 0 || b.Before > 24*60 || b.After > 24*60 {
+		return fmt.Errorf("buffers must be between 0 and %d minutes", 24*60)
+	}
+	return nil
+}
+
+// BufferConfig holds the buffers of all events, of the events of a
+// calendar and of the events with a keyword or a color. When several
+// match an event, the largest buffer on each side is used
+type BufferConfig struct {
+	Buffers
+	// By calendar id
+	Calendars map[string]Buffers `json:"calendars"`
+	// By a word in the summary of the event, ignoring case
+	Keywords map[string]Buffers `json:"keywords"`
+	// By the color id of the event
+	Colors map[string]Buffers `json:"colors"`
+}
+
+func (c BufferConfig) validate() error {
+	if err := c.Buffers.validate(); err != nil {
+		return err
+	}
+	for _, rules := range []map[string]Buffers{c.Calendars, c.Keywords, c.Colors} {
+		for name, b := range rules {
+			if err := b.validate(); err != nil {
+				return fmt.Errorf("%v: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// with adds buffers kept around all events, like the ones of a query.
+// They widen the configured ones, the largest buffer on each side is used
+func (c BufferConfig) with(b Buffers) BufferConfig {
+	c.Before = max(c.Before, b.Before)
+	c.After = max(c.After, b.After)
+	return c
+}
+
+// widest is the largest buffer of any event
+func (c BufferConfig) widest() time.Duration {
+	widest := max(c.Before, c.After)
+	for _, rules := range []map[string]Buffers{c.Calendars, c.Keywords, c.Colors} {
+		for _, b := range rules {
+			widest = max(widest, b.Before, b.After)
+		}
+	}
+	return time.Duration(widest) * time.Minute
+}
+
+// forEvent is the largest of the buffers matching the event of the calendar
+func (c BufferConfig) forEvent(calID string, e *calendar.Event) Buffers {
+	b := c.Buffers
+	widen := func(o Buffers) {
+		b.Before = max(b.Before, o.Before)
+		b.After = max(b.After, o.After)
+	}
+	if o, ok := c.Calendars[calID]; ok {
+		widen(o)
+	}
+	if o, ok := c.Colors[e.ColorId]; ok && e.ColorId != "" {
+		widen(o)
+	}
+	summary := strings.ToLower(e.Summary)
+	for keyword, o := range c.Keywords {
+		if keyword != "" && strings.Contains(summary, strings.ToLower(keyword)) {
+			widen(o)
+		}
+	}
+	return b
+}
+
+// apply widens the timed events of the calendar by their buffers. The
+// events are copied, and the copies remember the buffers they were given
+func (c BufferConfig) apply(calID string, events []*calendar.Event, loc *time.Location) []*calendar.Event {
+	buffered := make([]*calendar.Event, 0, len(events))
+	for _, e := range events {
+		b := c.forEvent(calID, e)
+		start, end, ok := eventTimes(e, loc)
+		if (b.Before == 0 && b.After == 0) || !ok || isAllDay(e) {
+			buffered = append(buffered, e)
+			continue
+		}
+		widened := *e
+		widened.Start = eventDateTime(start.Add(-time.Duration(b.Before)*time.Minute), loc)
+		widened.End = eventDateTime(end.Add(time.Duration(b.After)*time.Minute), loc)
+		props := &calendar.EventExtendedProperties{Private: make(map[string]string)}
+		if e.ExtendedProperties != nil {
+			props.Shared = e.ExtendedProperties.Shared
+			maps.Copy(props.Private, e.ExtendedProperties.Private)
+		}
+		props.Private[bufferBeforeKey] = strconv.Itoa(b.Before)
+		props.Private[bufferAfterKey] = strconv.Itoa(b.After)
+		widened.ExtendedProperties = props
+		buffered = append(buffered, &widened)
+	}
+	return buffered
+}
+
+// appliedBuffers are the buffers an event was widened by
+func appliedBuffers(e *calendar.Event) (before, after time.Duration) {
+	if e == nil || e.ExtendedProperties == nil {
+		return 0, 0
+	}
+	b, _ := strconv.Atoi(e.ExtendedProperties.Private[bufferBeforeKey])
+	a, _ := strconv.Atoi(e.ExtendedProperties.Private[bufferAfterKey])
+	return time.Duration(b) * time.Minute, time.Duration(a) * time.Minute
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+func TestFindSlotsSeesBuffersFromOutsideTheSearch(t *testing.T) {
+	// Ends the evening before the search, its buffer reaches into it
+	late := testEvent("Late shift", "", tomorrowAt(-2, 0), tomorrowAt(-1, 0))
+	src := NewMemorySource()
+	src.Add("primary", "Primary", late)
+	opts := testOpts(src, 30*time.Minute)
+	opts.buffers = BufferConfig{Keywords: map[string]Buffers{"shift": {After: 10 * 60}}}
+
+	results, err := findSlots(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results.Slots) != 1 || results.Slots[0].Start != tomorrowAt(9, 0) {
+		t.Fatalf("got %+v, want the slot to start at 9:00", results.Slots)
+	}
+	opts.buffers.Keywords["shift"] = Buffers{After: 11 * 60}
+	results, err = findSlots(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results.Slots) != 1 || !results.Slots[0].Start.Equal(tomorrowAt(10, 0)) {
+		t.Errorf("got %+v, want the buffer to keep the morning free", results.Slots)
+	}
+}
+
+func TestQueryBuffers(t *testing.T) {
+	defaults := &Config{Buffers: BufferConfig{Buffers: Buffers{Before: 10, After: 30}}}
+	tests := []struct {
+		name          string
+		before, after int
+		want          Buffers
+		fails         bool
+	}{
+		{"config only", 0, 0, Buffers{Before: 10, After: 30}, false},
+		{"query widens", 20, 15, Buffers{Before: 20, After: 30}, false},
+		{"negative", -5, 0, Buffers{}, true},
+		{"longer than a day", 0, 24*60 + 1, Buffers{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := Query{NumDays: 1, EventLoc: "Office", StartLoc: "Home", Duration: time.Hour, BufferBeforeMinutes: test.before, BufferAfterMinutes: test.after}
+			if err := query.validateSearch(); (err != nil) != test.fails {
+				t.Fatalf("got %v", err)
+			}
+			if test.fails {
+				return
+			}
+			opts, err := newSlotOpts(context.Background(), NewMemorySource(), lineDistance{}, defaults, query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.buffers.Buffers != test.want {
+				t.Errorf("got %+v, want %+v", opts.buffers.Buffers, test.want)
+			}
+		})
+	}
+	if defaults.Buffers.Before != 10 {
+		t.Error("a query changed the buffers of the config")
+	}
+}
+
+func TestBufferApply(t *testing.T) {
+	config := BufferConfig{
+		Buffers:   Buffers{Before: 5},
+		Calendars: map[string]Buffers{"work": {Before: 10, After: 10}},
+		Keywords:  map[string]Buffers{"Client": {After: 30}, "": {After: 600}},
+		Colors:    map[string]Buffers{"11": {Before: 45}},
+	}
+	start := time.Date(2030, 1, 7, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		calID         string
+		edit          func(e *calendar.Event)
+		before, after int
+	}{
+		{"all events", "home", func(e *calendar.Event) {}, 5, 0},
+		{"calendar", "work", func(e *calendar.Event) {}, 10, 10},
+		{"keyword in any case", "home", func(e *calendar.Event) { e.Summary = "Visit a CLIENT" }, 5, 30},
+		{"color", "home", func(e *calendar.Event) { e.ColorId = "11" }, 45, 0},
+		{"largest of each side", "work", func(e *calendar.Event) { e.Summary = "client"; e.ColorId = "11" }, 45, 30},
+		{"all day", "work", func(e *calendar.Event) {
+			e.Start = &calendar.EventDateTime{Date: "2030-01-07"}
+			e.End = &calendar.EventDateTime{Date: "2030-01-08"}
+		}, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := testEvent("Meeting", "", start, start.Add(time.Hour))
+			e.ExtendedProperties = &calendar.EventExtendedProperties{Private: map[string]string{"other": "kept"}}
+			test.edit(e)
+			original := *e
+			got := config.apply(test.calID, []*calendar.Event{e}, time.UTC)[0]
+			if test.before == 0 && test.after == 0 {
+				if got != e {
+					t.Errorf("an event without buffers was copied")
+				}
+				return
+			}
+			gotStart, gotEnd, _ := eventTimes(got, time.UTC)
+			wantStart := start.Add(-time.Duration(test.before) * time.Minute)
+			wantEnd := start.Add(time.Hour + time.Duration(test.after)*time.Minute)
+			if !gotStart.Equal(wantStart) || !gotEnd.Equal(wantEnd) {
+				t.Errorf("widened to %v-%v, want %v-%v", gotStart.Format("15:04"), gotEnd.Format("15:04"), wantStart.Format("15:04"), wantEnd.Format("15:04"))
+			}
+			if before, after := appliedBuffers(got); before != time.Duration(test.before)*time.Minute || after != time.Duration(test.after)*time.Minute {
+				t.Errorf("remembers buffers of %v and %v", before, after)
+			}
+			if got.ExtendedProperties.Private["other"] != "kept" {
+				t.Error("lost the other private properties")
+			}
+			if e.Start != original.Start || e.End != original.End || len(e.ExtendedProperties.Private) != 1 {
+				t.Error("changed the event of the calendar")
+			}
+		})
+	}
+	if widest := config.widest(); widest != 600*time.Minute {
+		t.Errorf("widest buffer %v", widest)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	distanceBucket = "distances"
+	geocodeBucket  = "geocodes"
+)
+
+// CacheCounter counts the lookups of a cache
+type CacheCounter struct {
+	hits, misses atomic.Int64
+}
+
+func (c *CacheCounter) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]int64{
+		"hits":   c.hits.Load(),
+		"misses": c.misses.Load(),
+	})
+}
+
+// Cache keeps distances and geocodes in the store so they survive restarts
+type Cache struct {
+	store     *Store
+	TTL       time.Duration
+	Distances CacheCounter
+	Geocodes  CacheCounter
+}
+
+func NewCache(store *Store, ttl time.Duration) *Cache {
+	return &Cache{store: store, TTL: ttl}
+}
+
+// DeleteExpired removes the distances and geocodes that expired before
+// now, along with the entries that can no longer be read
+func (c *Cache) DeleteExpired(now time.Time) (int, error) {
+	removed := 0
+	for _, bucket := range []string{distanceBucket, geocodeBucket} {
+		var stale []string
+		err := c.store.ForEach(bucket, func(key string, value []byte) error {
+			var entry struct{ Expires time.Time }
+			if err := json.Unmarshal(value, &entry); err != nil || !now.Before(entry.Expires) {
+				stale = append(stale, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return removed, err
+		}
+		if err := c.store.DeleteAll(bucket, stale); err != nil {
+			return removed, err
+		}
+		removed += len(stale)
+	}
+	return removed, nil
+}
+
+type cachedTravel struct {
+	Travel
+	Expires time.Time
+}
+
+type cachedCoords struct {
+	LatLng
+	Expires time.Time
+}
+
+// CachedDistance answers from the cache and only asks the provider for
+// the pairs that are missing or expired
+type CachedDistance struct {
+	Provider DistanceProvider
+	// Separates the entries of different providers and travel modes
+	Mode  string
+	cache *Cache
+}
+
+func (c *CachedDistance) key(origin, destination string) string {
+	return c.Mode + "|" + normalizeAddress(origin) + "|" + normalizeAddress(destination)
+}
+
+func (c *CachedDistance) DistanceMatrix(ctx context.Context, origins, destinations []string) (TravelMatrix, error) {
+	m := newTravelMatrix(len(origins), len(destinations))
+	now := time.Now()
+
+	// Only the origins and destinations with a missing pair are requested
+	missingOrigins := make(map[int]struct{})
+	missingDests := make(map[int]struct{})
+	for io, or := range origins {
+		for id, dest := range destinations {
+			var entry cachedTravel
+			found, err := c.cache.store.GetJSON(distanceBucket, c.key(or, dest), &entry)
+			if err != nil {
+				logger.Println("Unable to read distance cache", err)
+			}
+			if found && now.Before(entry.Expires) {
+				c.cache.Distances.hits.Add(1)
+				travel := entry.Travel
+				m[io][id] = &travel
+				continue
+			}
+			c.cache.Distances.misses.Add(1)
+			missingOrigins[io] = struct{}{}
+			missingDests[id] = struct{}{}
+		}
+	}
+	if len(missingOrigins) == 0 {
+		return m, nil
+	}
+
+	var reqOrigins, reqDests []string
+	var originIdx, destIdx []int
+	for io, or := range origins {
+		if _, ok := missingOrigins[io]; ok {
+			reqOrigins = append(reqOrigins, or)
+			originIdx = append(originIdx, io)
+		}
+	}
+	for id, dest := range destinations {
+		if _, ok := missingDests[id]; ok {
+			reqDests = append(reqDests, dest)
+			destIdx = append(destIdx, id)
+		}
+	}
+	part, err := c.Provider.DistanceMatrix(ctx, reqOrigins, reqDests)
+	if err != nil {
+		return nil, err
+	}
+	expires := now.Add(c.cache.TTL)
+	// The whole matrix is written at once
+	entries := make(map[string]any)
+	for i, row := range part {
+		for j, travel := range row {
+			if travel == nil {
+				continue
+			}
+			io, id := originIdx[i], destIdx[j]
+			m[io][id] = travel
+			entries[c.key(origins[io], destinations[id])] = cachedTravel{*travel, expires}
+		}
+	}
+	if err := c.cache.store.PutAllJSON(distanceBucket, entries); err != nil {
+		logger.Println("Unable to write distance cache", err)
+	}
+	return m, nil
+}
+
+// CachedGeocoder answers from the cache before asking the geocoder
+type CachedGeocoder struct {
+	Geocoder Geocoder
+	cache    *Cache
+}
+
+func (c *CachedGeocoder) Geocode(ctx context.Context, address string) (LatLng, error) {
+	key := normalizeAddress(address)
+	var entry cachedCoords
+	found, err := c.cache.store.GetJSON(geocodeBucket, key, &entry)
+	if err != nil {
+		logger.Println("Unable to read geocode cache", err)
+	}
+	if found && time.Now().Before(entry.Expires) {
+		c.cache.Geocodes.hits.Add(1)
+		return entry.LatLng, nil
+	}
+	c.cache.Geocodes.misses.Add(1)
+
+	coords, err := c.Geocoder.Geocode(ctx, address)
+	if err != nil {
+		return LatLng{}, err
+	}
+	err = c.cache.store.PutJSON(geocodeBucket, key, cachedCoords{coords, time.Now().Add(c.cache.TTL)})
+	if err != nil {
+		logger.Println("Unable to write geocode cache", err)
+	}
+	return coords, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// countingDistance counts the requests sent to the provider
+type countingDistance struct {
+	lineDistance
+	requests int
+}
+
+func (c *countingDistance) DistanceMatrix(ctx context.Context, origins, destinations []string) (TravelMatrix, error) {
+	c.requests++
+	return c.lineDistance.DistanceMatrix(ctx, origins, destinations)
+}
+
+func TestCachedDistance(t *testing.T) {
+	store, err := OpenStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	cache := NewCache(store, time.Hour)
+	provider := &countingDistance{lineDistance: lineDistance{"A": 0, "B": 10, "C": 30}}
+	cached := &CachedDistance{Provider: provider, Mode: "test", cache: cache}
+
+	ctx := context.Background()
+	addresses := []string{"A", "B", "C"}
+	if _, err := cached.DistanceMatrix(ctx, addresses, addresses); err != nil {
+		t.Fatal(err)
+	}
+	m, err := cached.DistanceMatrix(ctx, addresses, addresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider.requests != 1 {
+		t.Errorf("sent %d requests, the second matrix should come from the cache", provider.requests)
+	}
+	if got := m[0][2].Duration; got != 30*time.Minute {
+		t.Errorf("cached A to C takes %v", got)
+	}
+
+	if removed, err := cache.DeleteExpired(time.Now()); err != nil || removed != 0 {
+		t.Errorf("removed %d fresh entries, %v", removed, err)
+	}
+	if removed, err := cache.DeleteExpired(time.Now().Add(2 * time.Hour)); err != nil || removed != 9 {
+		t.Errorf("removed %d expired entries, %v", removed, err)
+	}
+	if _, err := cached.DistanceMatrix(ctx, addresses, addresses); err != nil {
+		t.Fatal(err)
+	}
+	if provider.requests != 2 {
+		t.Errorf("sent %d requests after the sweep", provider.requests)
+	}
+}
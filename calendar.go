@@ -1,14 +1,15 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"fmt"
-	"log"
+	"maps"
 	"slices"
 	"sort"
 	"time"
 
 	"google.golang.org/api/calendar/v3"
-	"googlemaps.github.io/maps"
 )
 
 type Date struct {
@@ -18,11 +19,28 @@ type Date struct {
 }
 
 func (d Date) Time() time.Time {
-	return time.Date(d.Year, d.Month, d.Day, 0, 0, 0, 0, time.Local)
+	return d.In(time.Local)
+}
+
+// In returns midnight of the date in the location
+func (d Date) In(loc *time.Location) time.Time {
+	return time.Date(d.Year, d.Month, d.Day, 0, 0, 0, 0, loc)
 }
 
 func (d Date) AddDate(years, months, days int) Date {
-	return TimeToDate(d.Time().AddDate(years, months, days))
+	// Done in UTC so that DST transitions cannot shift the date
+	return TimeToDate(d.In(time.UTC).AddDate(years, months, days))
+}
+
+// Before reports whether the date comes before o
+func (d Date) Before(o Date) bool {
+	if d.Year != o.Year {
+		return d.Year < o.Year
+	}
+	if d.Month != o.Month {
+		return d.Month < o.Month
+	}
+	return d.Day < o.Day
 }
 
 func TimeToDate(t time.Time) Date {
@@ -37,24 +55,20 @@ type Schedule struct {
 	Events []*calendar.Event
 }
 
-func (s *Schedule) Insert(e *calendar.Event) {
+// Insert adds the event keeping the events ordered by their start in loc
+func (s *Schedule) Insert(e *calendar.Event, loc *time.Location) {
 	if e.Start == nil {
-		log.Println("Event has no start time, skipping")
+		logger.Println("Event has no start time, skipping")
 		return
 	}
 	index := sort.Search(len(s.Events), func(i int) bool {
-		return s.Events[i].Start.DateTime >= e.Start.DateTime
+		return !eventStartsBefore(s.Events[i], e, loc)
 	})
 	s.Events = slices.Insert(s.Events, index, e)
 }
 
 type Calendar map[Date]Schedule
 
-const (
-	morningCutoff = 9
-	eveningCutoff = 17
-)
-
 func toEvent(e *calendar.Event) Event {
 	if e == nil {
 		return Event{}
@@ -76,202 +90,512 @@ type TimeSlot struct {
 	ComesBefore Event
 	Start       time.Time
 	End         time.Time
+	// Indexes of the neighbors in the day's schedule, -1 and the number
+	// of events when the slot is at the start or end of the day
+	from, to int
+}
+
+// isAllDay reports whether the event only has dates and no times
+func isAllDay(e *calendar.Event) bool {
+	return e.Start != nil && e.Start.DateTime == "" && e.Start.Date != ""
+}
+
+func parseEventTime(t *calendar.EventDateTime, loc *time.Location) (time.Time, error) {
+	if t.DateTime == "" {
+		// All day events start at midnight of the date
+		return time.ParseInLocation(time.DateOnly, t.Date, loc)
+	}
+	parsed, err := time.Parse(time.RFC3339, t.DateTime)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parsed.In(loc), nil
+}
+
+// eventTimes parses the start and end of an event in loc, all day events
+// end at midnight after their last day
+func eventTimes(e *calendar.Event, loc *time.Location) (start, end time.Time, ok bool) {
+	if e == nil || e.Start == nil || e.End == nil {
+		return time.Time{}, time.Time{}, false
+	}
+	start, err := parseEventTime(e.Start, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	end, err = parseEventTime(e.End, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	return start, end, true
+}
+
+func eventStartsBefore(a, b *calendar.Event, loc *time.Location) bool {
+	aStart, _, _ := eventTimes(a, loc)
+	bStart, _, _ := eventTimes(b, loc)
+	return aStart.Before(bStart)
+}
+
+// eventDays lists every date that the event covers in the location of end
+func eventDays(start, end time.Time) []Date {
+	last := TimeToDate(end)
+	if end.Equal(last.In(end.Location())) && end.After(start) {
+		// Ending at midnight does not cover the next day
+		last = last.AddDate(0, 0, -1)
+	}
+	var days []Date
+	for d := TimeToDate(start); !last.Before(d); d = d.AddDate(0, 0, 1) {
+		days = append(days, d)
+	}
+	return days
+}
+
+// BusyOptions decide which events block time
+type BusyOptions struct {
+	// Treat tentative events and invitations tentatively accepted as free,
+	// holds stay busy
+	TentativeFree bool
+	// Ignore all day events, for calendars that use them as reminders
+	IgnoreAllDay bool
 }
 
-func groupEventsByDay(allEvents []*calendar.Event) Calendar {
+// isBusy reports whether the event blocks the time it covers
+func (o BusyOptions) isBusy(e *calendar.Event) bool {
+	if e.Status == "cancelled" || e.Transparency == "transparent" {
+		return false
+	}
+	if o.IgnoreAllDay && isAllDay(e) {
+		return false
+	}
+	// Holds are tentative, but the slot is taken until they are released
+	if e.ExtendedProperties != nil && e.ExtendedProperties.Private[holdProperty] != "" {
+		return true
+	}
+	tentative := e.Status == "tentative"
+	for _, a := range e.Attendees {
+		if a == nil || !a.Self {
+			continue
+		}
+		switch a.ResponseStatus {
+		case "declined":
+			return false
+		case "tentative":
+			tentative = true
+		}
+	}
+	return !(tentative && o.TentativeFree)
+}
+
+// groupEventsByDay groups the busy events by the days of loc they cover
+func groupEventsByDay(allEvents []*calendar.Event, busy BusyOptions, loc *time.Location) Calendar {
 	cal := make(Calendar)
 	for _, e := range allEvents {
 		if e == nil || e.Start == nil {
 			continue
 		}
-		day, err := time.ParseInLocation(time.RFC3339, e.Start.DateTime, time.Local)
-		if err != nil {
-			fmt.Printf("Unable to parse date: %v\n", err)
+		if !busy.isBusy(e) {
 			continue
 		}
-		// If it is not between the morning and evening cutoff, skip it
-		if h := day.Hour(); h < morningCutoff || h >= eveningCutoff {
+		start, end, ok := eventTimes(e, loc)
+		if !ok {
+			logger.Printf("Unable to parse the dates of %v\n", e.Summary)
 			continue
 		}
-
-		date := TimeToDate(day)
-		if sch, ok := cal[date]; ok {
-			sch.Insert(e)
-		} else {
-			cal[date] = Schedule{Events: []*calendar.Event{e}}
+		// Events outside of working hours are kept, they still
+		// neighbor the slots at the edges of the day
+
+		// Multi day events block every day they cover
+		for _, date := range eventDays(start, end) {
+			sch := cal[date]
+			sch.Insert(e, loc)
+			cal[date] = sch
 		}
 	}
-	// Sort the events in each day
-	for _, sch := range cal {
-		sort.Slice(sch.Events, func(i, j int) bool {
-			return sch.Events[i].Start.DateTime < sch.Events[j].Start.DateTime
-		})
-	}
 	return cal
 }
 
-func (c Calendar) FindAvailableTimeSlots(start, end Date, duration time.Duration) []TimeSlot {
+// FindAvailableTimeSlots finds the gaps of at least duration within the
+// working hours of every day between start and end (inclusive), with the
+// working hours and days taken in loc
+func (c Calendar) FindAvailableTimeSlots(start, end Date, duration time.Duration, hours WorkingHours, loc *time.Location) []TimeSlot {
 	var slots []TimeSlot
 
-	for d := start; d.Time().Before(end.Time()) || d == end; d = d.AddDate(0, 0, 1) {
-		wd := d.Time().Weekday()
-		if wd == time.Saturday || wd == time.Sunday {
+	for d := start; !end.Before(d); d = d.AddDate(0, 0, 1) {
+		ranges := hours.For(d.Time().Weekday())
+		if len(ranges) == 0 {
 			continue
 		}
 
-		dayStart := time.Date(d.Year, d.Month, d.Day, morningCutoff, 0, 0, 0, time.Local)
-		dayEnd := time.Date(d.Year, d.Month, d.Day, eveningCutoff, 0, 0, 0, time.Local)
+		sch := c[d]
+		for _, r := range ranges {
+			slots = append(slots, sch.freeSlots(d, r.Start.On(d, loc), r.End.On(d, loc), duration)...)
+		}
+	}
+	return slots
+}
+
+// freeSlots finds the gaps of at least duration between windowStart and windowEnd,
+// the slots are given in the location of windowStart
+func (s Schedule) freeSlots(d Date, windowStart, windowEnd time.Time, duration time.Duration) []TimeSlot {
+	loc := windowStart.Location()
+	var slots []TimeSlot
+	after, before := -1, len(s.Events)
+	var afterEnd time.Time
 
-		sch, ok := c[d]
+	lastEnd := windowStart
+	for i, e := range s.Events {
+		eventStart, eventEnd, ok := eventTimes(e, loc)
 		if !ok {
-			slots = append(slots, TimeSlot{
-				Date:  d,
-				Start: dayStart,
-				End:   dayEnd,
-			})
 			continue
 		}
-
-		fmt.Printf("Processing date: %s\n", d.Time().Format("2006-01-02"))
-
-		lastEnd := dayStart
-		for i, e := range sch.Events {
-			fmt.Printf("Event: %s, Start: %s, End: %s\n", e.Summary, e.Start.DateTime, e.End.DateTime)
-			if e.Start == nil || e.End == nil {
-				continue
-			}
-			eventStart, _ := time.ParseInLocation(time.RFC3339, e.Start.DateTime, time.Local)
-			eventEnd, _ := time.ParseInLocation(time.RFC3339, e.End.DateTime, time.Local)
-			if eventStart.Sub(lastEnd) >= duration {
-				var after *calendar.Event
-				if i > 0 {
-					after = sch.Events[i-1]
-				}
-
-				slots = append(slots, TimeSlot{
-					Date:        d,
-					Start:       lastEnd,
-					End:         eventStart,
-					ComesAfter:  toEvent(after),
-					ComesBefore: toEvent(e),
-				})
-			}
-			if eventEnd.After(lastEnd) {
-				lastEnd = eventEnd
+		if !eventStart.Before(windowEnd) {
+			before = i
+			break
+		}
+		if !eventEnd.After(windowStart) {
+			// The event before the window is the one that ends last
+			if !eventEnd.Before(afterEnd) {
+				after, afterEnd = i, eventEnd
 			}
+			continue
 		}
-		if dayEnd.Sub(lastEnd) >= duration {
+		if eventStart.Sub(lastEnd) >= duration {
 			slots = append(slots, TimeSlot{
-				Date:       d,
-				Start:      lastEnd,
-				End:        dayEnd,
-				ComesAfter: toEvent(sch.Events[len(sch.Events)-1]),
+				Date:        d,
+				Start:       lastEnd,
+				End:         eventStart,
+				ComesAfter:  s.eventAt(after),
+				ComesBefore: toEvent(e),
+				from:        after,
+				to:          i,
 			})
 		}
+		if eventEnd.After(lastEnd) {
+			lastEnd = eventEnd
+			after = i
+		}
+	}
+	if windowEnd.Sub(lastEnd) >= duration {
+		slots = append(slots, TimeSlot{
+			Date:        d,
+			Start:       lastEnd,
+			End:         windowEnd,
+			ComesAfter:  s.eventAt(after),
+			ComesBefore: s.eventAt(before),
+			from:        after,
+			to:          before,
+		})
 	}
 	return slots
 }
 
-func findSlots(opts Opts) ([]LocatedTimeSlot, error) {
+// edges are the end of the event before the slot and the start of the
+// event after it, zero where the slot has no neighbor
+func (s *Schedule) edges(slot TimeSlot) (prevEnd, nextStart time.Time) {
+	loc := slot.Start.Location()
+	if slot.from >= 0 && slot.from < len(s.Events) {
+		if _, end, ok := eventTimes(s.Events[slot.from], loc); ok {
+			prevEnd = end
+		}
+	}
+	if slot.to >= 0 && slot.to < len(s.Events) {
+		if start, _, ok := eventTimes(s.Events[slot.to], loc); ok {
+			nextStart = start
+		}
+	}
+	return prevEnd, nextStart
+}
+
+// edgeBuffers are the buffers of the neighbors of the slot that set
+// where it starts and ends
+func (s *Schedule) edgeBuffers(slot TimeSlot) (in, out time.Duration) {
+	loc := slot.Start.Location()
+	if slot.from >= 0 && slot.from < len(s.Events) {
+		if _, end, ok := eventTimes(s.Events[slot.from], loc); ok && end.Equal(slot.Start) {
+			_, in = appliedBuffers(s.Events[slot.from])
+		}
+	}
+	if slot.to >= 0 && slot.to < len(s.Events) {
+		if start, _, ok := eventTimes(s.Events[slot.to], loc); ok && start.Equal(slot.End) {
+			out, _ = appliedBuffers(s.Events[slot.to])
+		}
+	}
+	return in, out
+}
+
+// eventAt is the event at the index, or no event outside of the schedule
+func (s Schedule) eventAt(i int) Event {
+	if i < 0 || i >= len(s.Events) {
+		return toEvent(nil)
+	}
+	return toEvent(s.Events[i])
+}
+
+// SlotResults are the slots found by findSlots
+type SlotResults struct {
+	Slots []LocatedTimeSlot
+	// Calendars whose events were cut off by the page cap,
+	// slots found in them may not actually be free
+	Truncated []string
+}
+
+func findSlots(opts Opts) (SlotResults, error) {
 
-	now := time.Now().In(time.Local).Truncate(time.Hour * 24).Add(time.Hour * 24)
-	allEvents, err := retrieveEvents(now, opts.numDays, opts.ids, opts.calendarService)
+	loc, startDate, endDate := searchDays(opts)
+
+	allEvents, truncated, err := retrieveEvents(opts.ctx, startDate.In(loc), opts.numDays, opts.ids, opts.source, opts.freeBusy, opts.buffers)
 	if err != nil {
-		return nil, err
+		return SlotResults{}, err
+	}
+
+	days := groupEventsByDay(allEvents, opts.busy, loc)
+
+	foundEvents := days.FindAvailableTimeSlots(startDate, endDate, opts.duration, opts.hours, loc)
+
+	travel, err := slotTravel(opts, foundEvents)
+	if err != nil {
+		return SlotResults{}, err
+	}
+	locatedEvents := make([]LocatedTimeSlot, 0, len(foundEvents))
+	for _, event := range foundEvents {
+		sch := days[event.Date]
+		slot, ok := travel.locate(event, &sch, opts)
+		if !ok {
+			continue
+		}
+		for _, candidate := range splitSlot(slot, opts) {
+			candidate.Score = scoreSlot(candidate, startDate, opts)
+			locatedEvents = append(locatedEvents, candidate)
+		}
 	}
 
-	days := groupEventsByDay(allEvents)
+	slices.SortFunc(locatedEvents, compareScores)
+	locatedEvents = capPerDay(locatedEvents, opts.perDay, func(s LocatedTimeSlot) Date { return s.Date })
+	return SlotResults{Slots: locatedEvents, Truncated: truncated}, nil
+}
 
-	// sortedDays := sortDays(days)
-	// for _, d := range sortedDays {
-	// 	day, found := days[d]
-	// 	if !found {
-	// 		continue
-	// 	}
-	// 	fmt.Println(d.Time().Format("Monday, January 2, 2006"))
-	// 	for _, event := range day.Events {
-	// 		fmt.Printf("\t%v\n", event.Summary)
-	// 	}
-	// }
+// searchDays is the first and last day searched by the options
+func searchDays(opts Opts) (loc *time.Location, startDate, endDate Date) {
+	loc = opts.loc
+	if loc == nil {
+		loc = time.Local
+	}
+	// The search starts tomorrow in the zone of the query
+	startDate = TimeToDate(time.Now().In(loc)).AddDate(0, 0, 1)
+	endDate = startDate.AddDate(0, 0, opts.numDays-1)
+	return loc, startDate, endDate
+}
 
-	startDate := Date{
-		Year: now.Year(), Month: now.Month(), Day: now.Day() + 1,
+// compareDetours orders the slots by the travel they add, then by distance
+func compareDetours(i, j LocatedTimeSlot) int {
+	if i.Detour != j.Detour {
+		return cmp.Compare(i.Detour, j.Detour)
 	}
-	endDate := startDate.AddDate(0, 0, opts.numDays-1)
+	return i.Distance - j.Distance
+}
 
-	foundEvents := days.FindAvailableTimeSlots(startDate, endDate, opts.duration)
+// TravelMaps holds the travel between the event, the start location
+// and the neighbors of the found slots
+type TravelMaps struct {
+	eventLocationMap, startLocationMap map[string]Travel
+	// Travel from the neighboring events into the event location
+	arrivalMap map[string]Travel
+	// Travel between the two neighbors of a slot, by origin and destination
+	directMap map[string]map[string]Travel
+}
 
-	// fmt.Println("Found spots:")
+// slotTravel looks up the travel for all the neighbors of the slots
+func slotTravel(opts Opts, foundEvents []TimeSlot) (*TravelMaps, error) {
 	locationSet := gatherLocations(foundEvents)
 
-	addresses := []string{}
+	neighbors := []string{}
 	for loc := range locationSet {
-		addresses = append(addresses, loc)
+		neighbors = append(neighbors, loc)
 	}
 
 	origins := []string{opts.eventLoc, opts.startLoc}
-	addresses = append(origins, addresses...)
-	distances, err := opts.mapService.DistanceMatrix(opts.ctx, &maps.DistanceMatrixRequest{
-		Origins:      origins,
-		Destinations: addresses,
-		Mode:         maps.TravelModeDriving,
-		Units:        maps.UnitsImperial,
-	})
+	addresses := append(origins, neighbors...)
+	distances, err := opts.distances.DistanceMatrix(opts.ctx, origins, addresses)
 	if err != nil {
-		fmt.Println("Unable to retrieve distances", err)
+		logger.Println("Unable to retrieve distances", err)
 		return nil, err
 	}
 
 	eventLocationMap, startLocationMap := sortDistances(origins, distances, addresses)
 
-	locatedEvents := make([]LocatedTimeSlot, len(foundEvents))
-	for i, event := range foundEvents {
-		distance := 0
-
-		if event.ComesAfter.Location != "" {
+	arrivalMap := make(map[string]Travel)
+	if len(neighbors) > 0 {
+		arrivals, err := opts.distances.DistanceMatrix(opts.ctx, neighbors, []string{opts.eventLoc})
+		if err != nil {
+			logger.Println("Unable to retrieve arrival times", err)
+			return nil, err
+		}
+		arrivalMap = sortArrivals(neighbors, arrivals)
+	}
 
-			distance += eventLocationMap[event.ComesAfter.Location]
-		} else {
+	directMap, err := directTravel(opts, foundEvents)
+	if err != nil {
+		return nil, err
+	}
+	return &TravelMaps{eventLocationMap, startLocationMap, arrivalMap, directMap}, nil
+}
 
-			distance += startLocationMap[opts.eventLoc]
+// directTravel looks up the travel from the event before each slot to the
+// event after it, the travel from the start location is already known
+func directTravel(opts Opts, foundEvents []TimeSlot) (map[string]map[string]Travel, error) {
+	pairs := make(map[string]map[string]struct{})
+	for _, event := range foundEvents {
+		from, to := event.ComesAfter.Location, event.ComesBefore.Location
+		if to == "" {
+			to = opts.startLoc
 		}
+		if from == "" || from == to {
+			continue
+		}
+		if pairs[from] == nil {
+			pairs[from] = make(map[string]struct{})
+		}
+		pairs[from][to] = struct{}{}
+	}
 
-		if event.ComesBefore.Location != "" {
-
-			distance += eventLocationMap[event.ComesBefore.Location]
-		} else {
+	if len(pairs) == 0 {
+		return map[string]map[string]Travel{}, nil
+	}
 
-			distance += eventLocationMap[opts.startLoc]
+	// One matrix from every origin to every destination, the provider
+	// splits it into requests that fit its limits
+	origins := make([]string, 0, len(pairs))
+	destinationSet := make(map[string]struct{})
+	for from, tos := range pairs {
+		origins = append(origins, from)
+		maps.Copy(destinationSet, tos)
+	}
+	destinations := make([]string, 0, len(destinationSet))
+	for to := range destinationSet {
+		destinations = append(destinations, to)
+	}
+	sort.Strings(origins)
+	sort.Strings(destinations)
+	distances, err := opts.distances.DistanceMatrix(opts.ctx, origins, destinations)
+	if err != nil {
+		logger.Println("Unable to retrieve travel between events", err)
+		return nil, err
+	}
+	directMap := make(map[string]map[string]Travel)
+	for io, from := range origins {
+		directMap[from] = make(map[string]Travel)
+		for to := range pairs[from] {
+			id, _ := slices.BinarySearch(destinations, to)
+			travel := distances[io][id]
+			if travel == nil {
+				logger.Printf("Unable to retrieve distance for %v and %v\n", from, to)
+				continue
+			}
+			directMap[from][to] = *travel
 		}
-		locatedEvents[i] = LocatedTimeSlot{TimeSlot: event, Distance: distance}
 	}
+	return directMap, nil
+}
+
+// travel is the known travel between two places, the start location and
+// the event location have travel to every place looked up
+func (t *TravelMaps) travel(from, to string, opts Opts) Travel {
+	switch {
+	case from == to:
+		return Travel{}
+	case from == opts.eventLoc:
+		return t.eventLocationMap[to]
+	case to == opts.eventLoc && from == opts.startLoc:
+		return t.startLocationMap[to]
+	case to == opts.eventLoc:
+		return t.arrivalMap[from]
+	case from == opts.startLoc:
+		return t.startLocationMap[to]
+	}
+	return t.directMap[from][to]
+}
 
-	slices.SortFunc(locatedEvents, func(i, j LocatedTimeSlot) int {
-		return i.Distance - j.Distance
-	})
-	return locatedEvents, nil
+// insertCost is the detour of going from the event at from to the event
+// at to through the event location
+func (t *TravelMaps) insertCost(sch *Schedule, from, to int, opts Opts) InsertCost {
+	c := InsertCost{Schedule: sch, From: from, To: to}
+	prev, next := c.location(from, opts), c.location(to, opts)
+	c.Cost = t.travel(prev, opts.eventLoc, opts).Duration +
+		t.travel(opts.eventLoc, next, opts).Duration -
+		t.travel(prev, next, opts).Duration
+	return c
+}
+
+// locate scores the slot by distance and detour and trims it by the travel
+// to and from its neighbors in the schedule, ok is false when the event no
+// longer fits
+func (t *TravelMaps) locate(event TimeSlot, sch *Schedule, opts Opts) (slot LocatedTimeSlot, ok bool) {
+	cost := t.insertCost(sch, event.from, event.to, opts)
+	prev, next := cost.location(event.from, opts), cost.location(event.to, opts)
+	distance := t.travel(prev, opts.eventLoc, opts).Meters + t.travel(opts.eventLoc, next, opts).Meters
+	slot = LocatedTimeSlot{TimeSlot: event, Distance: distance, Detour: cost.Cost}
+
+	// Leave time to drive between the neighbors and the event, unless they
+	// are already far enough from the slot, like the events outside of the
+	// working hours
+	if event.ComesAfter.Location != "" {
+		slot.TravelIn = t.arrivalMap[event.ComesAfter.Location].Duration
+	}
+	if event.ComesBefore.Location != "" {
+		slot.TravelOut = t.eventLocationMap[event.ComesBefore.Location].Duration
+	}
+	slot.BufferIn, slot.BufferOut = sch.edgeBuffers(event)
+	prevEnd, nextStart := sch.edges(event)
+	var gapIn, gapOut time.Duration
+	if !prevEnd.IsZero() {
+		gapIn = event.Start.Sub(prevEnd)
+	}
+	if !nextStart.IsZero() {
+		gapOut = nextStart.Sub(event.End)
+	}
+	slot.Start = slot.Start.Add(max(0, slot.TravelIn-gapIn))
+	slot.End = slot.End.Add(-max(0, slot.TravelOut-gapOut))
+	if slot.End.Sub(slot.Start) < opts.duration {
+		return LocatedTimeSlot{}, false
+	}
+	slot.ID = slotID(slot.Start, slot.End)
+	slot.gapStart, slot.gapEnd = slot.Start, slot.End
+	slot.prevEnd, slot.nextStart = prevEnd, nextStart
+	return slot, true
 }
 
-func sortDistances(origins []string, distances *maps.DistanceMatrixResponse, addresses []string) (map[string]int, map[string]int) {
-	eventLocationMap := make(map[string]int)
-	startLocationMap := make(map[string]int)
+func sortDistances(origins []string, distances TravelMatrix, addresses []string) (map[string]Travel, map[string]Travel) {
+	eventLocationMap := make(map[string]Travel)
+	startLocationMap := make(map[string]Travel)
 	for io, or := range origins {
-		for id, dist := range distances.Rows[io].Elements {
-			if dist.Status != "OK" {
-				fmt.Printf("Unable to retrieve distance for %v and %v", or, addresses[id])
+		for id, travel := range distances[io] {
+			if travel == nil {
+				logger.Printf("Unable to retrieve distance for %v and %v\n", or, addresses[id])
 				continue
 			}
 			if io == 0 {
-				eventLocationMap[addresses[id]] = dist.Distance.Meters
+				eventLocationMap[addresses[id]] = *travel
 			} else {
-				startLocationMap[addresses[id]] = dist.Distance.Meters
+				startLocationMap[addresses[id]] = *travel
 			}
-			// fmt.Println(or + " -> " + addresses[id] + ": " + dist.Distance.HumanReadable)
 		}
 	}
 	return eventLocationMap, startLocationMap
 }
 
+// sortArrivals maps each origin to its travel into the single destination
+func sortArrivals(origins []string, distances TravelMatrix) map[string]Travel {
+	arrivalMap := make(map[string]Travel)
+	for io, or := range origins {
+		travel := distances[io][0]
+		if travel == nil {
+			logger.Printf("Unable to retrieve arrival time from %v\n", or)
+			continue
+		}
+		arrivalMap[or] = *travel
+	}
+	return arrivalMap
+}
+
 func gatherLocations(foundEvents []TimeSlot) map[string]struct{} {
 	locationSet := make(map[string]struct{})
 	for _, event := range foundEvents {
@@ -288,41 +612,104 @@ func gatherLocations(foundEvents []TimeSlot) map[string]struct{} {
 	return locationSet
 }
 
-//	func sortDays(days Calendar) []Date {
-//		sortedDays := make([]Date, len(days))
-//		for d, sch := range days {
-//			if len(sch.Events) > 0 {
-//				sortedDays = append(sortedDays, d)
-//			}
-//		}
-//		slices.SortFunc(sortedDays, func(i, j Date) int {
-//			return i.Time().Compare(j.Time())
-//		})
-//		return sortedDays
-//	}
-func retrieveEvents(now time.Time, numDays int, calIDs []string, calendarService *calendar.Service) ([]*calendar.Event, error) {
+// retrieveEvents lists the events of every calendar, along with the
+// ids of the calendars that were truncated. Calendars that are read with
+// free/busy give anonymous events for their busy intervals
+func retrieveEvents(ctx context.Context, now time.Time, numDays int, calIDs []string, source EventSource, mode FreeBusyMode, buffers BufferConfig) ([]*calendar.Event, []string, error) {
 	allEvents := []*calendar.Event{}
-	max := now.AddDate(0, 0, numDays)
+	var truncated []string
+	// Events just outside of the search still block it with their buffers
+	reach := buffers.widest()
+	timeMin, timeMax := now.Add(-reach), now.AddDate(0, 0, numDays).Add(reach)
+	busySource, canFreeBusy := source.(FreeBusySource)
+	if mode == FreeBusyAlways && !canFreeBusy {
+		return nil, nil, fmt.Errorf("the calendar source has no free/busy information")
+	}
+	var busyIDs []string
 	for _, id := range calIDs {
+		if mode == FreeBusyAlways {
+			busyIDs = append(busyIDs, id)
+			continue
+		}
 
-		events, err := calendarService.Events.List(id).TimeMin(now.Format(time.RFC3339)).TimeMax(max.Format(time.RFC3339)).SingleEvents(true).Do()
+		events, cut, err := source.ListEvents(ctx, id, timeMin, timeMax)
+		// Calendars shared as free/busy only cannot be listed, other
+		// failures are not hidden behind free/busy
+		if mode == FreeBusyFallback && canFreeBusy && isAccessError(err) {
+			logger.Println("Unable to retrieve events of", id, "using free/busy instead:", err)
+			busyIDs = append(busyIDs, id)
+			continue
+		}
 		if err != nil {
-			fmt.Println("Unable to retrieve events", err)
-			return nil, err
+			logger.Println("Unable to retrieve events", err)
+			return nil, nil, err
 		}
-		// filter the events to those that are between the morning and evening cutoff
-		allEvents = append(allEvents, events.Items...)
+		if cut {
+			truncated = append(truncated, id)
+		}
+		allEvents = append(allEvents, buffers.apply(id, events, now.Location())...)
 	}
-	return allEvents, nil
+
+	if len(busyIDs) > 0 {
+		busy, err := busySource.FreeBusy(ctx, busyIDs, timeMin, timeMax)
+		if err != nil {
+			logger.Println("Unable to retrieve free/busy", err)
+			return nil, nil, err
+		}
+		for _, id := range busyIDs {
+			allEvents = append(allEvents, buffers.apply(id, busyEvents(busy[id]), now.Location())...)
+		}
+	}
+	return allEvents, truncated, nil
 }
 
+// LocatedTimeSlot is a slot trimmed by the travel to and from its neighbors
 type LocatedTimeSlot struct {
 	TimeSlot
+	// Identifies the window of the slot when booking it
+	ID       string
 	Distance int
+	// Driving time from the event before and to the event after the slot
+	TravelIn  time.Duration
+	TravelOut time.Duration
+	// Time kept free after the event before and before the event after
+	// the slot, on top of the driving
+	BufferIn  time.Duration
+	BufferOut time.Duration
+	// Driving time the event adds to the day
+	Detour time.Duration
+	// Slots are ranked by their score
+	Score SlotScore
+	// Free window the slot is in, the slot itself unless it was split
+	gapStart, gapEnd time.Time
+	// End of the event before and start of the event after the slot,
+	// zero where there is none
+	prevEnd, nextStart time.Time
 }
 
+// adjacent reports whether the free window reaches up to the events
+// around it, apart from the travel to and from them
+func (s LocatedTimeSlot) adjacent() (afterPrev, beforeNext bool) {
+	afterPrev = !s.prevEnd.IsZero() && !s.gapStart.After(s.prevEnd.Add(s.TravelIn))
+	beforeNext = !s.nextStart.IsZero() && !s.gapEnd.Before(s.nextStart.Add(-s.TravelOut))
+	return afterPrev, beforeNext
+}
+
+// InsertCost is the travel time added to the day of a schedule by going
+// to the event between the events at From and To, instead of straight
+// from one to the other. From is -1 and To the number of events when the
+// day starts or ends at the start location
 type InsertCost struct {
 	*Schedule
 	Cost     time.Duration
 	From, To int
 }
+
+// location is where the schedule is at the index, the start location
+// outside of the day and for events without one
+func (c InsertCost) location(i int, opts Opts) string {
+	if i < 0 || i >= len(c.Events) || c.Events[i].Location == "" {
+		return opts.startLoc
+	}
+	return c.Events[i].Location
+}
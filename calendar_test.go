@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+func TestDirectTravelIsOneRequest(t *testing.T) {
+	src := NewMemorySource()
+	src.Add("primary", "Primary",
+		testEvent("A", "North", tomorrowAt(9, 0), tomorrowAt(9, 30)),
+		testEvent("B", "South", tomorrowAt(11, 0), tomorrowAt(11, 30)),
+		testEvent("C", "East", tomorrowAt(13, 0), tomorrowAt(13, 30)),
+		testEvent("D", "North", tomorrowAt(15, 0), tomorrowAt(15, 30)),
+	)
+	distances := &countingDistance{lineDistance: lineDistance{"North": 5, "South": 10, "East": 15}}
+	opts := testOpts(src, 30*time.Minute)
+	opts.distances = distances
+
+	results, err := findSlots(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results.Slots) == 0 {
+		t.Fatal("no slots found")
+	}
+	// From the event and start locations, to the event location and
+	// between the events
+	if distances.requests != 3 {
+		t.Errorf("sent %d distance requests, want 3", distances.requests)
+	}
+}
+
+func TestFreeSlots(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2030, 1, 7, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name   string
+		events []*calendar.Event
+		want   []string
+	}{
+		{"empty day", nil, []string{"09:00-17:00 -/-"}},
+		{"meeting at noon", []*calendar.Event{testEvent("Lunch", "", at(12, 0), at(13, 0))},
+			[]string{"09:00-12:00 -/Lunch", "13:00-17:00 Lunch/-"}},
+		{"gap too short", []*calendar.Event{
+			testEvent("A", "", at(9, 0), at(12, 0)),
+			testEvent("B", "", at(12, 30), at(17, 0)),
+		}, nil},
+		{"overlapping events", []*calendar.Event{
+			testEvent("Long", "", at(10, 0), at(14, 0)),
+			testEvent("Short", "", at(11, 0), at(12, 0)),
+		}, []string{"09:00-10:00 -/Long", "14:00-17:00 Long/-"}},
+		{"events outside the window", []*calendar.Event{
+			testEvent("Early", "", at(5, 0), at(6, 0)),
+			testEvent("Breakfast", "", at(7, 0), at(8, 0)),
+			testEvent("Dinner", "", at(19, 0), at(20, 0)),
+		}, []string{"09:00-17:00 Breakfast/Dinner"}},
+		{"event running into the window", []*calendar.Event{testEvent("Night shift", "", at(0, 0), at(9, 30))},
+			[]string{"09:30-17:00 Night shift/-"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var sch Schedule
+			for _, e := range test.events {
+				sch.Insert(e, time.UTC)
+			}
+			var got []string
+			for _, s := range sch.freeSlots(TimeToDate(at(0, 0)), at(9, 0), at(17, 0), time.Hour) {
+				got = append(got, fmt.Sprintf("%v-%v %v/%v", s.Start.Format("15:04"), s.End.Format("15:04"),
+					firstNonEmpty(s.ComesAfter.Summary, "-"), firstNonEmpty(s.ComesBefore.Summary, "-")))
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFindSlots(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []*calendar.Event
+		want   []string
+	}{
+		{"empty day", nil, []string{"09:00-17:00"}},
+		{"meeting at the office", []*calendar.Event{testEvent("Standup", "Office", tomorrowAt(12, 0), tomorrowAt(13, 0))},
+			[]string{"09:00-12:00", "13:00-17:00"}},
+		{"meeting 30 minutes away", []*calendar.Event{testEvent("Visit", "Far", tomorrowAt(12, 0), tomorrowAt(13, 0))},
+			[]string{"09:00-11:30", "13:30-17:00"}},
+		{"travel fits in the gap to early events", []*calendar.Event{
+			testEvent("Gym", "Far", tomorrowAt(6, 0), tomorrowAt(8, 0)),
+			testEvent("Dinner", "Far", tomorrowAt(18, 0), tomorrowAt(20, 0)),
+		}, []string{"09:00-17:00"}},
+		{"travel longer than the gap", []*calendar.Event{testEvent("Breakfast", "Far", tomorrowAt(8, 0), tomorrowAt(8, 45))},
+			[]string{"09:15-17:00"}},
+		{"no time for the travel", []*calendar.Event{
+			testEvent("A", "Far", tomorrowAt(9, 0), tomorrowAt(12, 0)),
+			testEvent("B", "Far", tomorrowAt(13, 15), tomorrowAt(17, 0)),
+		}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := NewMemorySource()
+			src.Add("primary", "Primary", test.events...)
+			opts := testOpts(src, 30*time.Minute)
+			opts.distances = lineDistance{"Far": 30}
+			results, err := findSlots(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, s := range results.Slots {
+				got = append(got, s.Start.Format("15:04")+"-"+s.End.Format("15:04"))
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIsBusy(t *testing.T) {
+	event := func(edit func(e *calendar.Event)) *calendar.Event {
+		e := testEvent("Meeting", "", tomorrowAt(10, 0), tomorrowAt(11, 0))
+		e.Status = "confirmed"
+		edit(e)
+		return e
+	}
+	attending := func(status string) func(e *calendar.Event) {
+		return func(e *calendar.Event) {
+			e.Attendees = []*calendar.EventAttendee{
+				{Email: "organizer@example.com", ResponseStatus: "accepted"},
+				nil,
+				{Email: "me@example.com", Self: true, ResponseStatus: status},
+			}
+		}
+	}
+	allDay := func(e *calendar.Event) {
+		e.Start = &calendar.EventDateTime{Date: "2030-01-07"}
+		e.End = &calendar.EventDateTime{Date: "2030-01-08"}
+	}
+	hold := func(e *calendar.Event) {
+		e.Status = "tentative"
+		e.ExtendedProperties = &calendar.EventExtendedProperties{Private: map[string]string{holdProperty: "group"}}
+	}
+	strict := BusyOptions{}
+	lenient := BusyOptions{TentativeFree: true, IgnoreAllDay: true}
+	tests := []struct {
+		name          string
+		event         *calendar.Event
+		strict, loose bool
+	}{
+		{"confirmed", event(func(e *calendar.Event) {}), true, true},
+		{"cancelled", event(func(e *calendar.Event) { e.Status = "cancelled" }), false, false},
+		{"shown as free", event(func(e *calendar.Event) { e.Transparency = "transparent" }), false, false},
+		{"tentative", event(func(e *calendar.Event) { e.Status = "tentative" }), true, false},
+		{"accepted", event(attending("accepted")), true, true},
+		{"declined", event(attending("declined")), false, false},
+		{"tentatively accepted", event(attending("tentative")), true, false},
+		{"not answered", event(attending("needsAction")), true, true},
+		{"all day", event(allDay), true, false},
+		{"hold", event(hold), true, true},
+		{"hold shown as free", event(func(e *calendar.Event) { hold(e); e.Transparency = "transparent" }), false, false},
+	}
+	for _, test := range tests {
+		if got := strict.isBusy(test.event); got != test.strict {
+			t.Errorf("%v: busy %v by default", test.name, got)
+		}
+		if got := lenient.isBusy(test.event); got != test.loose {
+			t.Errorf("%v: busy %v with tentative and all day events free", test.name, got)
+		}
+	}
+}
+
+func TestEventDays(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		start, end *calendar.EventDateTime
+		loc        *time.Location
+		want       []string
+	}{
+		{"all day", &calendar.EventDateTime{Date: "2030-01-07"}, &calendar.EventDateTime{Date: "2030-01-08"},
+			time.UTC, []string{"2030-01-07"}},
+		{"all day for three days", &calendar.EventDateTime{Date: "2030-01-07"}, &calendar.EventDateTime{Date: "2030-01-10"},
+			time.UTC, []string{"2030-01-07", "2030-01-08", "2030-01-09"}},
+		{"all day across months", &calendar.EventDateTime{Date: "2030-01-31"}, &calendar.EventDateTime{Date: "2030-02-02"},
+			berlin, []string{"2030-01-31", "2030-02-01"}},
+		{"overnight", &calendar.EventDateTime{DateTime: "2030-01-07T22:00:00Z"}, &calendar.EventDateTime{DateTime: "2030-01-08T02:00:00Z"},
+			time.UTC, []string{"2030-01-07", "2030-01-08"}},
+		{"ending at midnight", &calendar.EventDateTime{DateTime: "2030-01-07T22:00:00Z"}, &calendar.EventDateTime{DateTime: "2030-01-08T00:00:00Z"},
+			time.UTC, []string{"2030-01-07"}},
+		{"ending at midnight elsewhere", &calendar.EventDateTime{DateTime: "2030-01-07T22:00:00Z"}, &calendar.EventDateTime{DateTime: "2030-01-08T00:00:00Z"},
+			berlin, []string{"2030-01-07", "2030-01-08"}},
+		{"at midnight without a duration", &calendar.EventDateTime{DateTime: "2030-01-08T00:00:00Z"}, &calendar.EventDateTime{DateTime: "2030-01-08T00:00:00Z"},
+			time.UTC, []string{"2030-01-08"}},
+		{"a week of conference", &calendar.EventDateTime{DateTime: "2030-01-07T09:00:00+01:00"}, &calendar.EventDateTime{DateTime: "2030-01-11T17:00:00+01:00"},
+			berlin, []string{"2030-01-07", "2030-01-08", "2030-01-09", "2030-01-10", "2030-01-11"}},
+	}
+	for _, test := range tests {
+		e := &calendar.Event{Start: test.start, End: test.end}
+		start, end, ok := eventTimes(e, test.loc)
+		if !ok {
+			t.Errorf("%v: unable to parse the times", test.name)
+			continue
+		}
+		var got []string
+		for _, d := range eventDays(start, end) {
+			got = append(got, d.Time().Format(time.DateOnly))
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMultiDayEventsBlockEveryDay(t *testing.T) {
+	src := NewMemorySource()
+	vacation := &calendar.Event{
+		Summary: "Vacation",
+		Start:   &calendar.EventDateTime{Date: tomorrowAt(0, 0).Format(time.DateOnly)},
+		End:     &calendar.EventDateTime{Date: tomorrowAt(0, 0).AddDate(0, 0, 2).Format(time.DateOnly)},
+	}
+	trip := testEvent("Trip", "", tomorrowAt(0, 0).AddDate(0, 0, 2).Add(15*time.Hour), tomorrowAt(0, 0).AddDate(0, 0, 3).Add(10*time.Hour))
+	src.Add("primary", "Primary", vacation, trip)
+	opts := testOpts(src, 30*time.Minute)
+	opts.numDays = 4
+
+	results, err := findSlots(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range results.Slots {
+		got = append(got, s.Start.Format("Jan 2 15:04")+"-"+s.End.Format("15:04"))
+	}
+	slices.Sort(got)
+	day := func(offset int, hours string) string {
+		return tomorrowAt(0, 0).AddDate(0, 0, offset).Format("Jan 2 ") + hours
+	}
+	want := []string{day(2, "09:00-15:00"), day(3, "10:00-17:00")}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	opts.busy.IgnoreAllDay = true
+	if results, err = findSlots(opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(results.Slots) != 4 {
+		t.Errorf("%d slots when ignoring the vacation, want 4", len(results.Slots))
+	}
+}
+
+func TestSlotsAcrossDST(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	early := WorkingHours{time.Sunday: {{Start: 1 * 60, End: 5 * 60}}}
+	tests := []struct {
+		name   string
+		day    Date
+		hours  WorkingHours
+		loc    *time.Location
+		events []*calendar.Event
+		want   []string
+	}{
+		{"regular day", Date{2030, time.January, 6}, early, berlin, nil,
+			[]string{"2030-01-06T01:00:00+01:00/4h0m0s"}},
+		{"clocks skip an hour", Date{2030, time.March, 31}, early, berlin, nil,
+			[]string{"2030-03-31T01:00:00+01:00/3h0m0s"}},
+		{"clocks repeat an hour", Date{2030, time.October, 27}, early, berlin, nil,
+			[]string{"2030-10-27T01:00:00+02:00/5h0m0s"}},
+		{"other zone", Date{2030, time.March, 10}, early, newYork, nil,
+			[]string{"2030-03-10T01:00:00-05:00/3h0m0s"}},
+		{"event in utc", Date{2030, time.March, 31}, early, berlin,
+			[]*calendar.Event{testEvent("Call", "", time.Date(2030, 3, 31, 0, 0, 0, 0, time.UTC), time.Date(2030, 3, 31, 1, 0, 0, 0, time.UTC))},
+			[]string{"2030-03-31T03:00:00+02:00/2h0m0s"}},
+		{"event of the day before in utc", Date{2030, time.March, 31}, early, berlin,
+			[]*calendar.Event{testEvent("Flight", "", time.Date(2030, 3, 30, 23, 0, 0, 0, time.UTC), time.Date(2030, 3, 31, 0, 30, 0, 0, time.UTC))},
+			[]string{"2030-03-31T01:30:00+01:00/2h30m0s"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cal := groupEventsByDay(test.events, BusyOptions{}, test.loc)
+			var got []string
+			for _, s := range cal.FindAvailableTimeSlots(test.day, test.day, time.Hour, test.hours, test.loc) {
+				got = append(got, s.Start.Format(time.RFC3339)+"/"+s.End.Sub(s.Start).String())
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestQueryTimeZone(t *testing.T) {
+	defaults := &Config{TimeZone: "Asia/Tokyo", WorkingHours: DefaultWorkingHours()}
+	query := Query{NumDays: 1, Duration: time.Hour, EventLoc: "Office", StartLoc: "Home", TimeZone: "America/Sao_Paulo"}
+	for _, test := range []struct {
+		zone, want string
+	}{
+		{"America/Sao_Paulo", "America/Sao_Paulo"},
+		{"", "Asia/Tokyo"},
+	} {
+		query.TimeZone = test.zone
+		opts, err := newSlotOpts(context.Background(), NewMemorySource(), lineDistance{}, defaults, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opts.loc.String() != test.want {
+			t.Errorf("zone %q searched in %v, want %v", test.zone, opts.loc, test.want)
+		}
+	}
+	query.TimeZone = "Mars/Olympus"
+	if err := query.validateSearch(); err == nil {
+		t.Error("an unknown zone is valid")
+	}
+
+	saoPaulo, _ := time.LoadLocation("America/Sao_Paulo")
+	slot := LocatedTimeSlot{TimeSlot: TimeSlot{Start: time.Date(2030, 1, 7, 9, 0, 0, 0, saoPaulo)}}
+	b, err := json.Marshal(slot)
+	if err != nil || !strings.Contains(string(b), `"Start":"2030-01-07T09:00:00-03:00"`) {
+		t.Errorf("slot times without their offset: %s, %v", b, err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"slices"
+	"time"
+)
+
+// splitSlot turns the free window of the slot into candidates of the
+// event's duration, starting at every multiple of the granularity since
+// midnight, and right next to the neighbors when adjacent times are
+// preferred. The slot is kept whole when there is no granularity
+func splitSlot(slot LocatedTimeSlot, opts Opts) []LocatedTimeSlot {
+	if opts.granularity <= 0 {
+		return []LocatedTimeSlot{slot}
+	}
+	midnight := slot.Date.In(slot.Start.Location())
+	step := opts.granularity
+	offset := slot.Start.Sub(midnight)
+	start := midnight.Add((offset + step - 1) / step * step)
+
+	var starts []time.Time
+	for ; !start.Add(opts.duration).After(slot.End); start = start.Add(step) {
+		starts = append(starts, start)
+	}
+	// Times right next to the events are off the steps after the travel
+	if opts.preferAdjacent {
+		afterPrev, beforeNext := slot.adjacent()
+		if afterPrev {
+			starts = append(starts, slot.Start)
+		}
+		if beforeNext {
+			starts = append(starts, slot.End.Add(-opts.duration))
+		}
+		slices.SortFunc(starts, time.Time.Compare)
+		starts = slices.CompactFunc(starts, time.Time.Equal)
+	}
+
+	candidates := make([]LocatedTimeSlot, 0, len(starts))
+	for _, start := range starts {
+		candidate := slot
+		candidate.Start, candidate.End = start, start.Add(opts.duration)
+		candidate.ID = slotID(candidate.Start, candidate.End)
+		candidates = append(candidates, candidate)
+	}
+	return candidates
+}
+
+// capPerDay keeps the first slots of each day up to the limit, all of
+// them if the limit is zero
+func capPerDay[S any](slots []S, limit int, date func(S) Date) []S {
+	if limit <= 0 {
+		return slots
+	}
+	counts := make(map[Date]int)
+	kept := slots[:0]
+	for _, s := range slots {
+		d := date(s)
+		if counts[d] >= limit {
+			continue
+		}
+		counts[d]++
+		kept = append(kept, s)
+	}
+	return kept
+}
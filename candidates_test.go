@@ -0,0 +1,104 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSplitSlotAdjacency(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2030, 1, 7, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name string
+		// Neighbors of the 9:10 to 10:20 window, zero when there is none
+		prevEnd, nextStart time.Time
+		travelIn           time.Duration
+		want               []string
+	}{
+		{"no neighbors", time.Time{}, time.Time{}, 0, []string{"09:30"}},
+		{"after the travel", at(9, 0), time.Time{}, 10 * time.Minute, []string{"09:10", "09:30"}},
+		{"right before the next", time.Time{}, at(10, 20), 0, []string{"09:30", "09:55"}},
+		{"neighbors before the working hours", at(5, 0), time.Time{}, 10 * time.Minute, []string{"09:30"}},
+		{"neighbors after the working hours", time.Time{}, at(18, 0), 0, []string{"09:30"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			slot := LocatedTimeSlot{
+				TimeSlot: TimeSlot{
+					Date:        TimeToDate(at(0, 0)),
+					ComesAfter:  Event{Summary: "Before"},
+					ComesBefore: Event{Summary: "After"},
+					Start:       at(9, 10),
+					End:         at(10, 20),
+				},
+				TravelIn:  test.travelIn,
+				gapStart:  at(9, 10),
+				gapEnd:    at(10, 20),
+				prevEnd:   test.prevEnd,
+				nextStart: test.nextStart,
+			}
+			opts := Opts{granularity: 30 * time.Minute, duration: 25 * time.Minute, preferAdjacent: true}
+			var got []string
+			for _, c := range splitSlot(slot, opts) {
+				got = append(got, c.Start.Format("15:04"))
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("starts %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSplitSlot(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2030, 1, 7, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name        string
+		start, end  time.Time
+		granularity time.Duration
+		want        []string
+	}{
+		{"whole window", at(9, 10), at(11, 0), 0, []string{"09:10-11:00"}},
+		{"half hours", at(9, 0), at(11, 0), 30 * time.Minute, []string{"09:00-10:00", "09:30-10:30", "10:00-11:00"}},
+		{"steps from midnight", at(9, 10), at(11, 0), 30 * time.Minute, []string{"09:30-10:30", "10:00-11:00"}},
+		{"no step fits", at(9, 10), at(10, 20), time.Hour, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			slot := LocatedTimeSlot{TimeSlot: TimeSlot{Date: TimeToDate(at(0, 0)), Start: test.start, End: test.end}}
+			var got []string
+			for _, c := range splitSlot(slot, Opts{granularity: test.granularity, duration: time.Hour}) {
+				got = append(got, c.Start.Format("15:04")+"-"+c.End.Format("15:04"))
+				if c.ID != slotID(c.Start, c.End) && test.granularity > 0 {
+					t.Errorf("candidate %v has the id %v", got[len(got)-1], c.ID)
+				}
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCapPerDay(t *testing.T) {
+	monday, tuesday := TimeToDate(time.Date(2030, 1, 7, 0, 0, 0, 0, time.UTC)), TimeToDate(time.Date(2030, 1, 8, 0, 0, 0, 0, time.UTC))
+	days := []Date{monday, tuesday, monday, monday, tuesday, monday}
+	tests := []struct {
+		limit int
+		want  []Date
+	}{
+		{0, days},
+		{1, []Date{monday, tuesday}},
+		{2, []Date{monday, tuesday, monday, tuesday}},
+		{10, days},
+	}
+	for _, test := range tests {
+		got := capPerDay(slices.Clone(days), test.limit, func(d Date) Date { return d })
+		if !slices.Equal(got, test.want) {
+			t.Errorf("limit %d kept %v, want %v", test.limit, got, test.want)
+		}
+	}
+}
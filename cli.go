@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const usage = `Usage: calendargo <command> [flags]
+
+Commands:
+  serve      run the web server (the default)
+  login      log in with Google and save the token locally
+  calendars  list the calendars that can be searched
+  slots      find available slots
+  book       create an event in a slot
+
+Run calendargo <command> -h for the flags of a command.
+`
+
+// runCommand runs one of the command line tools
+func runCommand(cmd string, args []string) error {
+	logger.SetOutput(os.Stderr)
+	switch cmd {
+	case "login":
+		return runLogin(args)
+	case "calendars":
+		return runCalendars(args)
+	case "slots":
+		return runSlots(args)
+	case "book":
+		return runBook(args)
+	case "help":
+		fmt.Print(usage)
+		return nil
+	}
+	fmt.Fprint(os.Stderr, usage)
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+// stringList is a flag that can be given more than once
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// cliFlags are the flags shared by the command line tools
+type cliFlags struct {
+	config    string
+	dataPath  string
+	tokenPath string
+}
+
+func (c *cliFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&c.config, "config", "", "path of the config file (env CALENDARGO_CONFIG)")
+	flags.StringVar(&c.dataPath, "data", "", "path of the database (env CALENDARGO_DATA_PATH)")
+	flags.StringVar(&c.tokenPath, "token", "", "path of the saved token (env CALENDARGO_TOKEN)")
+}
+
+func (c *cliFlags) token() string {
+	if path := firstNonEmpty(c.tokenPath, os.Getenv("CALENDARGO_TOKEN")); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "calendargo-token.json"
+	}
+	return filepath.Join(dir, "calendargo", "token.json")
+}
+
+// load reads the config like the server does, without its server settings
+func (c *cliFlags) load() (*Config, error) {
+	path := firstNonEmpty(c.config, os.Getenv("CALENDARGO_CONFIG"))
+	config, err := LoadConfig(firstNonEmpty(path, defaultConfigPath))
+	if err != nil {
+		if path != "" || !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("unable to load config: %w", err)
+		}
+		config = &Config{}
+	}
+	config.DataPath = firstNonEmpty(c.dataPath, os.Getenv("CALENDARGO_DATA_PATH"), config.DataPath, "./calendargo.db")
+	if len(config.WorkingHours) == 0 {
+		config.WorkingHours = DefaultWorkingHours()
+	}
+	if err := config.validateSearch(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return config, nil
+}
+
+// cliState is what the commands that read calendars need
+type cliState struct {
+	ctx    context.Context
+	config *Config
+	store  *Store
+	source EventSource
+}
+
+// open loads the config, the database and the saved token
+func (c *cliFlags) open() (*cliState, error) {
+	config, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	token, err := loadToken(c.token())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("not logged in, run calendargo login first")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the token: %w", err)
+	}
+	store, err := OpenStore(config.DataPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the database %v, a running server may be using it: %w", config.DataPath, err)
+	}
+	ics, err := createICSSource(config, store)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("unable to load the iCalendar files: %w", err)
+	}
+
+	ctx := context.Background()
+	// Refreshing the token does not need the redirect url
+	ts := savedTokenSource(ctx, oauthFromEnv(""), c.token(), token)
+	svc, err := newCalendarService(ctx, ts)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	google := NewGoogleSource(svc, config.PageSize, config.MaxPages)
+	// Uploads belong to the users of the server, only the local files are read
+	source := &MultiSource{Default: google, Prefixed: map[string]EventSource{icsPrefix: ics.For("")}}
+	return &cliState{ctx: ctx, config: config, store: store, source: source}, nil
+}
+
+func (s *cliState) Close() {
+	if err := s.store.Close(); err != nil {
+		logger.Println("Unable to close the database", err)
+	}
+}
+
+// interactive reports whether the user can be asked for missing values
+func interactive() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// required asks for a missing flag value when the user can answer
+func required(value *string, name, prompt string) error {
+	if *value != "" {
+		return nil
+	}
+	if !interactive() {
+		return fmt.Errorf("-%v is required", name)
+	}
+	input, err := readInput(prompt)
+	if err != nil || input == "" {
+		return fmt.Errorf("-%v is required", name)
+	}
+	*value = input
+	return nil
+}
+
+func runLogin(args []string) error {
+	flags := flag.NewFlagSet("login", flag.ContinueOnError)
+	var common cliFlags
+	common.register(flags)
+	redirectURL := flags.String("redirect-url", "", "loopback url of the OAuth client, http://localhost:8080/authcallback if empty (env CALENDARGO_CLI_REDIRECT_URL)")
+	timeout := flags.Duration("timeout", 2*time.Minute, "how long to wait for the login")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config := oauthFromEnv(firstNonEmpty(*redirectURL, os.Getenv("CALENDARGO_CLI_REDIRECT_URL"), "http://localhost:8080/authcallback"))
+	state := randState()
+	if state == "" {
+		return fmt.Errorf("unable to start login")
+	}
+	code := getAuthCode(config, *timeout, state)
+	if code == "" {
+		return fmt.Errorf("no auth code received")
+	}
+	token, err := config.Exchange(context.Background(), code)
+	if err != nil {
+		return fmt.Errorf("unable to exchange auth code: %w", err)
+	}
+	path := common.token()
+	if err := saveToken(path, token); err != nil {
+		return fmt.Errorf("unable to save the token: %w", err)
+	}
+	fmt.Println("Logged in, the token is saved in", path)
+	return nil
+}
+
+func runCalendars(args []string) error {
+	flags := flag.NewFlagSet("calendars", flag.ContinueOnError)
+	var common cliFlags
+	common.register(flags)
+	asJSON := flags.Bool("json", false, "print the calendars as json")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	state, err := common.open()
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+
+	cals, truncated, err := state.source.ListCalendars(state.ctx)
+	if err != nil {
+		return fmt.Errorf("unable to list calendars: %w", err)
+	}
+	if truncated {
+		fmt.Fprintln(os.Stderr, "The calendar list was truncated")
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(cals)
+	}
+	for _, c := range cals {
+		fmt.Printf("%v\t%v\n", c.Id, c.Summary)
+	}
+	return nil
+}
+
+func runSlots(args []string) error {
+	flags := flag.NewFlagSet("slots", flag.ContinueOnError)
+	var common cliFlags
+	common.register(flags)
+	days := flags.Int("days", 7, "number of days to search, starting tomorrow")
+	duration := flags.Duration("duration", time.Hour, "length of the event")
+	at := flags.String("at", "", "location of the event")
+	from := flags.String("from", "", "where the day starts, start_address of the config if empty")
+	var calIDs stringList
+	flags.Var(&calIDs, "cal", "calendar to search, can be repeated (default primary)")
+	zone := flags.String("tz", "", "IANA time zone of the working hours, time_zone of the config if empty")
+	format := flags.String("format", formatMarkdown, "output format: md, json, ics or csv")
+	limit := flags.Int("limit", 0, "print at most this many slots, all if zero")
+	tentativeFree := flags.Bool("tentative-free", false, "treat tentative events as free")
+	ignoreAllDay := flags.Bool("ignore-all-day", false, "ignore all day events")
+	freeBusy := flags.String("free-busy", "", "read calendars as free/busy: always or never, only when listing is refused if empty")
+	prefer := flags.String("prefer", "", "preferred start of the event as HH:MM")
+	weightList := flags.String("weights", "", "score weights as travel=4,time=1,proximity=1,fragmentation=1,buffer=1")
+	granularity := flags.Duration("granularity", 0, "step between candidate starts, whole free windows if zero")
+	perDay := flags.Int("per-day", 0, "most slots for a day, all if zero")
+	preferAdjacent := flags.Bool("prefer-adjacent", false, "rate candidates next to events higher")
+	bufferBefore := flags.Duration("buffer-before", 0, "time kept free before every event, on top of the buffers of the config")
+	bufferAfter := flags.Duration("buffer-after", 0, "time kept free after every event, on top of the buffers of the config")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	weights, err := parseScoreWeights(*weightList)
+	if err != nil {
+		return err
+	}
+	if _, ok := formatTypes[*format]; !ok {
+		return fmt.Errorf("unknown format %q, use md, json, ics or csv", *format)
+	}
+	if err := required(at, "at", "Enter the location you want to search for:"); err != nil {
+		return err
+	}
+
+	state, err := common.open()
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+	cfg := state.config
+	if *from == "" {
+		*from = cfg.StartAddress
+	}
+	if err := required(from, "from", "Enter the location you want to start from:"); err != nil {
+		return err
+	}
+	if len(calIDs) == 0 {
+		calIDs = stringList{"primary"}
+	}
+
+	distances, err := createDistanceProvider(cfg.Routing, newConfigCache(cfg, state.store))
+	if err != nil {
+		return fmt.Errorf("unable to create distance provider: %w", err)
+	}
+	query := Query{
+		NumDays:       *days,
+		EventLoc:      *at,
+		StartLoc:      *from,
+		Duration:      *duration,
+		CalIds:        calIDs,
+		TentativeFree: *tentativeFree,
+		IgnoreAllDay:  *ignoreAllDay,
+		TimeZone:      firstNonEmpty(*zone, cfg.TimeZone),
+		FreeBusy:      FreeBusyMode(*freeBusy),
+		Weights:       &weights,
+		PreferredTime: *prefer,
+
+		GranularityMinutes: int(granularity.Minutes()),
+		MaxPerDay:          *perDay,
+		PreferAdjacent:     *preferAdjacent,
+
+		BufferBeforeMinutes: int(bufferBefore.Minutes()),
+		BufferAfterMinutes:  int(bufferAfter.Minutes()),
+	}
+	if err := query.validate(); err != nil {
+		return err
+	}
+	opts, err := newSlotOpts(state.ctx, state.source, distances, cfg, query)
+	if err != nil {
+		return err
+	}
+
+	results, err := findSlots(opts)
+	if err != nil {
+		return fmt.Errorf("unable to find available spots: %w", err)
+	}
+	if len(results.Truncated) > 0 {
+		fmt.Fprintln(os.Stderr, "Results were truncated for", strings.Join(results.Truncated, ", "))
+	}
+	slots := results.Slots
+	if *limit > 0 && len(slots) > *limit {
+		slots = slots[:*limit]
+	}
+
+	if *format == formatJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(slots)
+	}
+	out, err := exportSlots(*format, slots, query.EventLoc, opts.loc)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+func runBook(args []string) error {
+	flags := flag.NewFlagSet("book", flag.ContinueOnError)
+	var common cliFlags
+	common.register(flags)
+	slot := flags.String("slot", "", "id of a slot printed by calendargo slots -format json or csv")
+	start := flags.String("start", "", "start of the event as 2006-01-02T15:04, instead of -slot")
+	duration := flags.Duration("duration", 0, "length of the event, the whole slot if zero")
+	title := flags.String("title", "", "title of the event")
+	description := flags.String("description", "", "description of the event")
+	location := flags.String("location", "", "location of the event")
+	calID := flags.String("cal", "primary", "calendar the event is created in")
+	var checkIDs, attendees stringList
+	flags.Var(&checkIDs, "check-cal", "calendar that has to be free, can be repeated (default -cal)")
+	flags.Var(&attendees, "attendee", "email of someone to invite, can be repeated")
+	zone := flags.String("tz", "", "IANA time zone of -start and the event, time_zone of the config if empty")
+	tentativeFree := flags.Bool("tentative-free", false, "treat tentative events as free")
+	ignoreAllDay := flags.Bool("ignore-all-day", false, "ignore all day events")
+	bufferBefore := flags.Duration("buffer-before", 0, "time kept free before every event, on top of the buffers of the config")
+	bufferAfter := flags.Duration("buffer-after", 0, "time kept free after every event, on top of the buffers of the config")
+	yes := flags.Bool("yes", false, "book without asking for confirmation")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := required(title, "title", "Enter the title of the event:"); err != nil {
+		return err
+	}
+
+	state, err := common.open()
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+	loc, err := loadLocation(firstNonEmpty(*zone, state.config.TimeZone))
+	if err != nil {
+		return err
+	}
+
+	booking := Booking{
+		SlotID:      *slot,
+		Duration:    *duration,
+		CalId:       *calID,
+		CheckCalIds: checkIDs,
+		Title:       *title,
+		Description: *description,
+		Location:    *location,
+		Attendees:   attendees,
+		TimeZone:    loc.String(),
+
+		TentativeFree:       *tentativeFree,
+		IgnoreAllDay:        *ignoreAllDay,
+		BufferBeforeMinutes: int(bufferBefore.Minutes()),
+		BufferAfterMinutes:  int(bufferAfter.Minutes()),
+	}
+	if *start != "" {
+		if *slot != "" {
+			return fmt.Errorf("give either -slot or -start")
+		}
+		if *duration <= 0 {
+			return fmt.Errorf("-start needs a -duration")
+		}
+		t, err := time.ParseInLocation("2006-01-02T15:04", *start, loc)
+		if err != nil {
+			return fmt.Errorf("invalid -start: %w", err)
+		}
+		booking.Slot = &TimeSlot{Start: t, End: t.Add(*duration)}
+	}
+	if loc == time.Local {
+		booking.TimeZone = ""
+	}
+	if err := booking.validate(); err != nil {
+		return err
+	}
+
+	if !*yes {
+		if !interactive() {
+			return fmt.Errorf("pass -yes to book without confirmation")
+		}
+		eventStart, eventEnd, _ := booking.window()
+		answer, err := readInput(fmt.Sprintf("Book %q on %v-%v? [y/N]", booking.Title,
+			eventStart.In(loc).Format("Mon Jan 2 15:04"), eventEnd.In(loc).Format("15:04")))
+		if err != nil {
+			return fmt.Errorf("pass -yes to book without confirmation")
+		}
+		if !strings.EqualFold(answer, "y") && !strings.EqualFold(answer, "yes") {
+			fmt.Println("Not booked")
+			return nil
+		}
+	}
+
+	created, err := bookEvent(state.ctx, state.source, booking, loc, state.config.Buffers)
+	if err != nil {
+		return fmt.Errorf("unable to book the slot: %w", err)
+	}
+	fmt.Println("Booked", created.HtmlLink)
+	return nil
+}
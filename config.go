@@ -4,20 +4,22 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"time"
-
-	"google.golang.org/api/calendar/v3"
-	"googlemaps.github.io/maps"
 )
 
 var reader = bufio.NewReader(os.Stdin)
 
 func readInput(prompt string) (string, error) {
-	fmt.Println(prompt)
+	fmt.Fprintln(os.Stderr, prompt)
 	input, err := reader.ReadString('\n')
 	if err != nil {
 		return "", err
@@ -38,8 +40,170 @@ func readNumber(prompt string) (int, error) {
 }
 
 type Config struct {
-	StartAddress string  `json:"start_address"`
-	EndAddress   *string `json:"end_address,omitempty"`
+	StartAddress string       `json:"start_address"`
+	EndAddress   *string      `json:"end_address,omitempty"`
+	WorkingHours WorkingHours `json:"working_hours,omitempty"`
+	// Paging of the calendar API, zero uses the defaults
+	PageSize int64 `json:"page_size,omitempty"`
+	MaxPages int   `json:"max_pages,omitempty"`
+	// IANA name of the default zone for queries, the server's zone if empty
+	TimeZone string `json:"time_zone,omitempty"`
+	// Which service the travel between events is computed with
+	Routing RoutingConfig `json:"routing,omitempty"`
+	// Local iCalendar files served as calendars, by name. Their
+	// calendar ids are the name prefixed with "ics:"
+	ICSFiles map[string]string `json:"ics_files,omitempty"`
+	// Minutes until holds that were not confirmed are released, a day if zero
+	HoldMinutes int `json:"hold_minutes,omitempty"`
+	// Time kept free around busy events, for all events or by calendar,
+	// keyword or color
+	Buffers BufferConfig `json:"buffers,omitempty"`
+	// Path of the database for cached distances and sessions
+	DataPath string       `json:"data_path,omitempty"`
+	Server   ServerConfig `json:"server"`
+}
+
+// ServerConfig is where and how the web server is reachable
+type ServerConfig struct {
+	// Domain the cookies are set for, host only cookies if empty
+	Domain string `json:"domain,omitempty"`
+	// Where Google sends users back to after logging in
+	RedirectURL string `json:"redirect_url"`
+	ListenAddr  string `json:"listen_addr"`
+	// Directory of the built client
+	StaticDir string `json:"static_dir"`
+	// Allow cookies over plain http, for local development
+	InsecureCookies bool `json:"insecure_cookies,omitempty"`
+}
+
+const defaultConfigPath = "./config.json"
+
+// loadServerConfig builds the configuration from the config file, then
+// the environment, then the command line flags, each overriding the last
+func loadServerConfig(args []string) (*Config, error) {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	configPath := flags.String("config", "", "path of the config file (env CALENDARGO_CONFIG)")
+	domain := flags.String("domain", "", "domain of the session cookies (env CALENDARGO_DOMAIN)")
+	redirectURL := flags.String("redirect-url", "", "OAuth redirect url (env CALENDARGO_REDIRECT_URL)")
+	listenAddr := flags.String("listen", "", "address to listen on (env CALENDARGO_LISTEN_ADDR)")
+	staticDir := flags.String("static-dir", "", "directory of the built client (env CALENDARGO_STATIC_DIR)")
+	dataPath := flags.String("data", "", "path of the database (env CALENDARGO_DATA_PATH)")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	path := firstNonEmpty(*configPath, os.Getenv("CALENDARGO_CONFIG"))
+	config, err := LoadConfig(firstNonEmpty(path, defaultConfigPath))
+	if err != nil {
+		// Only a config file that was asked for has to exist
+		if path != "" || !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("unable to load config: %w", err)
+		}
+		logger.Println("No config file found, using defaults")
+		config = &Config{}
+	}
+
+	srv := &config.Server
+	srv.Domain = firstNonEmpty(*domain, os.Getenv("CALENDARGO_DOMAIN"), srv.Domain)
+	srv.RedirectURL = firstNonEmpty(*redirectURL, os.Getenv("CALENDARGO_REDIRECT_URL"), srv.RedirectURL)
+	srv.ListenAddr = firstNonEmpty(*listenAddr, os.Getenv("CALENDARGO_LISTEN_ADDR"), srv.ListenAddr, "localhost:8080")
+	srv.StaticDir = firstNonEmpty(*staticDir, os.Getenv("CALENDARGO_STATIC_DIR"), srv.StaticDir, "./dist")
+	config.DataPath = firstNonEmpty(*dataPath, os.Getenv("CALENDARGO_DATA_PATH"), config.DataPath, "./calendargo.db")
+	if len(config.WorkingHours) == 0 {
+		config.WorkingHours = DefaultWorkingHours()
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return config, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func (c *Config) validate() error {
+	if err := c.validateSearch(); err != nil {
+		return err
+	}
+	return c.Server.validate()
+}
+
+// validateSearch checks everything but the server, which the command
+// line tools do not use
+func (c *Config) validateSearch() error {
+	if err := c.WorkingHours.validate(); err != nil {
+		return fmt.Errorf("working_hours: %w", err)
+	}
+	if _, err := loadLocation(c.TimeZone); err != nil {
+		return fmt.Errorf("time_zone: %w", err)
+	}
+	if c.PageSize < 0 || c.MaxPages < 0 {
+		return fmt.Errorf("page_size and max_pages cannot be negative")
+	}
+	for name := range c.ICSFiles {
+		if err := validateICSName(name); err != nil {
+			return fmt.Errorf("ics_files: %w", err)
+		}
+	}
+	if c.HoldMinutes < 0 {
+		return fmt.Errorf("hold_minutes cannot be negative")
+	}
+	if err := c.Routing.validate(); err != nil {
+		return fmt.Errorf("routing: %w", err)
+	}
+	if err := c.Buffers.validate(); err != nil {
+		return fmt.Errorf("buffers: %w", err)
+	}
+	return nil
+}
+
+func (s ServerConfig) validate() error {
+	if s.RedirectURL == "" {
+		return fmt.Errorf("redirect_url is required")
+	}
+	u, err := url.Parse(s.RedirectURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("redirect_url %q is not an absolute http(s) url", s.RedirectURL)
+	}
+	if u.Scheme == "http" && !s.InsecureCookies {
+		return fmt.Errorf("redirect_url uses http, set insecure_cookies to allow it")
+	}
+	if s.Domain != "" {
+		// The callback has to be able to see the cookies
+		host, domain := u.Hostname(), strings.TrimPrefix(s.Domain, ".")
+		if host != domain && !strings.HasSuffix(host, "."+domain) {
+			return fmt.Errorf("redirect_url host %q is not within domain %q", host, s.Domain)
+		}
+	}
+	if _, _, err := net.SplitHostPort(s.ListenAddr); err != nil {
+		return fmt.Errorf("listen_addr: %w", err)
+	}
+	info, err := os.Stat(s.StaticDir)
+	if err != nil {
+		return fmt.Errorf("static_dir: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("static_dir %q is not a directory", s.StaticDir)
+	}
+	return nil
+}
+
+// Print writes the effective configuration
+func (c *Config) Print() {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		logger.Println("Unable to print config", err)
+		return
+	}
+	logger.Println("Effective config:")
+	logger.Println(string(b))
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -61,42 +225,26 @@ func LoadConfig(path string) (*Config, error) {
 
 }
 
-// func initializeOptions() Opts {
-// 	err := godotenv.Load("./.env")
-// 	if err != nil {
-// 		log.Fatal("Error loading .env file")
-// 	}
-// 	ctx := context.Background()
-// 	config := oauthFromEnv()
-// 	calendarService := createCalendarService(ctx, config, "temp")
-// 	mapService := createMapService()
-// 	eventLocation, err := readInput("Enter the location you want to search for:")
-// 	if err != nil {
-// 		log.Fatalf("Unable to read input: %v", err)
-// 	}
-// 	startLocation, err := readInput("Enter the location you want to start from:")
-// 	if err != nil {
-// 		log.Fatalf("Unable to read input: %v", err)
-// 	}
-// 	numDays, err := readNumber("Enter the number of days you want to search through:")
-// 	if err != nil {
-// 		log.Fatalf("Unable to read input: %v", err)
-// 	}
-// 	numHours, err := readNumber("Enter the number of hours for the event:")
-// 	if err != nil {
-// 		log.Fatalf("Unable to read input: %v", err)
-// 	}
-// 	duration := time.Hour * time.Duration(numHours)
-// 	opts := Opts{ctx, calendarService, mapService, numDays, duration, eventLocation, startLocation}
-// 	return opts
-// }
-
 type Opts struct {
 	ctx                context.Context
-	calendarService    *calendar.Service
-	mapService         *maps.Client
+	source             EventSource
+	distances          DistanceProvider
 	numDays            int
 	duration           time.Duration
 	eventLoc, startLoc string
 	ids                []string
+	hours              WorkingHours
+	busy               BusyOptions
+	freeBusy           FreeBusyMode
+	loc                *time.Location
+	weights            ScoreWeights
+	// Preferred start of the event, no time is preferred if nil
+	prefer *ClockTime
+	// Step between the candidate starts in a free window, the whole
+	// window is one slot if zero
+	granularity time.Duration
+	// Most slots kept for a day, all if zero
+	perDay         int
+	preferAdjacent bool
+	buffers        BufferConfig
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServerConfigValidate(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "index.html")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	valid := ServerConfig{RedirectURL: "https://plan.example.com/auth/callback", ListenAddr: "localhost:8080", StaticDir: dir}
+	tests := []struct {
+		name  string
+		edit  func(s *ServerConfig)
+		error string
+	}{
+		{"valid", func(s *ServerConfig) {}, ""},
+		{"no redirect url", func(s *ServerConfig) { s.RedirectURL = "" }, "redirect_url is required"},
+		{"relative redirect url", func(s *ServerConfig) { s.RedirectURL = "/auth/callback" }, "not an absolute"},
+		{"other scheme", func(s *ServerConfig) { s.RedirectURL = "ftp://plan.example.com/" }, "not an absolute"},
+		{"plain http", func(s *ServerConfig) { s.RedirectURL = "http://localhost:8080/auth/callback" }, "insecure_cookies"},
+		{"plain http allowed", func(s *ServerConfig) {
+			s.RedirectURL = "http://localhost:8080/auth/callback"
+			s.InsecureCookies = true
+		}, ""},
+		{"same domain", func(s *ServerConfig) { s.Domain = "plan.example.com" }, ""},
+		{"parent domain", func(s *ServerConfig) { s.Domain = ".example.com" }, ""},
+		{"other domain", func(s *ServerConfig) { s.Domain = "example.org" }, "not within domain"},
+		{"domain suffix only", func(s *ServerConfig) { s.Domain = "an.example.com" }, "not within domain"},
+		{"listen without port", func(s *ServerConfig) { s.ListenAddr = "localhost" }, "listen_addr"},
+		{"missing static dir", func(s *ServerConfig) { s.StaticDir = filepath.Join(dir, "missing") }, "static_dir"},
+		{"static file", func(s *ServerConfig) { s.StaticDir = file }, "not a directory"},
+	}
+	for _, test := range tests {
+		s := valid
+		test.edit(&s)
+		err := s.validate()
+		if test.error == "" && err != nil || test.error != "" && (err == nil || !strings.Contains(err.Error(), test.error)) {
+			t.Errorf("%v: got %v, want %q", test.name, err, test.error)
+		}
+	}
+}
+
+func TestConfigValidateSearch(t *testing.T) {
+	tests := []struct {
+		name  string
+		json  string
+		error string
+	}{
+		{"empty", `{}`, ""},
+		{"everything", `{"time_zone": "Europe/Berlin", "page_size": 100, "max_pages": 5, "hold_minutes": 30,
+			"working_hours": {"mon": ["09:00-12:00"]}, "routing": {"provider": "haversine"}}`, ""},
+		{"unknown zone", `{"time_zone": "Mars/Olympus"}`, "time_zone"},
+		{"negative paging", `{"max_pages": -1}`, "max_pages"},
+		{"negative holds", `{"hold_minutes": -5}`, "hold_minutes"},
+		{"osrm without url", `{"routing": {"provider": "osrm"}}`, "routing: osrm_url"},
+		{"unknown provider", `{"routing": {"provider": "carrier pigeon"}}`, "routing"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(test.json), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		config, err := LoadConfig(path)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		err = config.validateSearch()
+		if test.error == "" && err != nil || test.error != "" && (err == nil || !strings.Contains(err.Error(), test.error)) {
+			t.Errorf("%v: got %v, want %q", test.name, err, test.error)
+		}
+	}
+}
+
+func TestLoadServerConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	config := `{"server": {"domain": "file.example.com", "redirect_url": "https://file.example.com/cb",
+		"listen_addr": "file:1", "static_dir": "` + dir + `"}, "data_path": "file.db"}`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"CALENDARGO_CONFIG", "CALENDARGO_DOMAIN", "CALENDARGO_REDIRECT_URL",
+		"CALENDARGO_LISTEN_ADDR", "CALENDARGO_STATIC_DIR", "CALENDARGO_DATA_PATH"} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("CALENDARGO_CONFIG", path)
+	t.Setenv("CALENDARGO_DOMAIN", "env.example.com")
+	t.Setenv("CALENDARGO_REDIRECT_URL", "https://env.example.com/cb")
+	t.Setenv("CALENDARGO_LISTEN_ADDR", "env:2")
+
+	got, err := loadServerConfig([]string{"-listen", "flag:3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ServerConfig{Domain: "env.example.com", RedirectURL: "https://env.example.com/cb", ListenAddr: "flag:3", StaticDir: dir}
+	if got.Server != want {
+		t.Errorf("got %+v, want %+v", got.Server, want)
+	}
+	if got.DataPath != "file.db" {
+		t.Errorf("data path %q, want the one of the file", got.DataPath)
+	}
+	if len(got.WorkingHours) == 0 {
+		t.Error("no default working hours")
+	}
+
+	// A config file that was asked for has to exist
+	if _, err := loadServerConfig([]string{"-config", filepath.Join(dir, "missing.json")}); err == nil {
+		t.Error("loaded a missing config file")
+	}
+	// Settings are checked after they are combined
+	if _, err := loadServerConfig([]string{"-redirect-url", "http://flag.example.com/cb"}); err == nil || !strings.Contains(err.Error(), "insecure_cookies") {
+		t.Errorf("got %v, want the redirect url to be refused", err)
+	}
+}
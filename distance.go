@@ -0,0 +1,562 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"googlemaps.github.io/maps"
+)
+
+// Travel is the distance and driving time between two places
+type Travel struct {
+	Meters   int
+	Duration time.Duration
+}
+
+// TravelMatrix holds the travel from every origin (row) to every
+// destination (column), nil where no route was found
+type TravelMatrix [][]*Travel
+
+// DistanceProvider computes travel between addresses
+type DistanceProvider interface {
+	DistanceMatrix(ctx context.Context, origins, destinations []string) (TravelMatrix, error)
+}
+
+func newTravelMatrix(rows, cols int) TravelMatrix {
+	m := make(TravelMatrix, rows)
+	for i := range m {
+		m[i] = make([]*Travel, cols)
+	}
+	return m
+}
+
+// GoogleDistance uses the Google Maps distance matrix
+type GoogleDistance struct {
+	client *maps.Client
+}
+
+func (g *GoogleDistance) DistanceMatrix(ctx context.Context, origins, destinations []string) (TravelMatrix, error) {
+	resp, err := g.client.DistanceMatrix(ctx, &maps.DistanceMatrixRequest{
+		Origins:      origins,
+		Destinations: destinations,
+		Mode:         maps.TravelModeDriving,
+		Units:        maps.UnitsImperial,
+	})
+	if err != nil {
+		return nil, err
+	}
+	m := newTravelMatrix(len(origins), len(destinations))
+	for io, row := range resp.Rows {
+		if io >= len(origins) {
+			break
+		}
+		for id, el := range row.Elements {
+			if id >= len(destinations) || el.Status != "OK" {
+				continue
+			}
+			m[io][id] = &Travel{Meters: el.Distance.Meters, Duration: el.Duration}
+		}
+	}
+	return m, nil
+}
+
+// LatLng is a geographic coordinate in degrees
+type LatLng struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// parseLatLng parses coordinates written as "lat,lng"
+func parseLatLng(s string) (LatLng, bool) {
+	lat, lng, found := strings.Cut(s, ",")
+	if !found {
+		return LatLng{}, false
+	}
+	la, err := strconv.ParseFloat(strings.TrimSpace(lat), 64)
+	if err != nil || la < -90 || la > 90 {
+		return LatLng{}, false
+	}
+	ln, err := strconv.ParseFloat(strings.TrimSpace(lng), 64)
+	if err != nil || ln < -180 || ln > 180 {
+		return LatLng{}, false
+	}
+	return LatLng{Lat: la, Lng: ln}, true
+}
+
+// Geocoder finds the coordinates of an address
+type Geocoder interface {
+	Geocode(ctx context.Context, address string) (LatLng, error)
+}
+
+// GoogleGeocoder uses the Google Maps geocoding API
+type GoogleGeocoder struct {
+	client *maps.Client
+}
+
+func (g *GoogleGeocoder) Geocode(ctx context.Context, address string) (LatLng, error) {
+	results, err := g.client.Geocode(ctx, &maps.GeocodingRequest{Address: address})
+	if err != nil {
+		return LatLng{}, err
+	}
+	if len(results) == 0 {
+		return LatLng{}, fmt.Errorf("no results for %q", address)
+	}
+	loc := results[0].Geometry.Location
+	return LatLng{Lat: loc.Lat, Lng: loc.Lng}, nil
+}
+
+// NominatimGeocoder uses a Nominatim search endpoint, which can be self hosted
+type NominatimGeocoder struct {
+	BaseURL string
+	client  *http.Client
+}
+
+func (n *NominatimGeocoder) Geocode(ctx context.Context, address string) (LatLng, error) {
+	u := strings.TrimSuffix(n.BaseURL, "/") + "/search?" + url.Values{
+		"q":      {address},
+		"format": {"json"},
+		"limit":  {"1"},
+	}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return LatLng{}, err
+	}
+	req.Header.Set("User-Agent", "calendargo")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return LatLng{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return LatLng{}, fmt.Errorf("nominatim returned %v", resp.Status)
+	}
+	var results []struct {
+		Lat string `json:"lat"`
+		Lon string `json:"lon"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return LatLng{}, err
+	}
+	if len(results) == 0 {
+		return LatLng{}, fmt.Errorf("no results for %q", address)
+	}
+	coords, ok := parseLatLng(results[0].Lat + "," + results[0].Lon)
+	if !ok {
+		return LatLng{}, fmt.Errorf("invalid coordinates for %q", address)
+	}
+	return coords, nil
+}
+
+// StaticGeocoder answers from a fixed table and "lat,lng" addresses
+// before falling back to the next geocoder, which may be nil
+type StaticGeocoder struct {
+	Known map[string]LatLng
+	Next  Geocoder
+}
+
+func (s *StaticGeocoder) Geocode(ctx context.Context, address string) (LatLng, error) {
+	if coords, ok := s.Known[normalizeAddress(address)]; ok {
+		return coords, nil
+	}
+	if coords, ok := parseLatLng(address); ok {
+		return coords, nil
+	}
+	if s.Next == nil {
+		return LatLng{}, fmt.Errorf("unknown address %q", address)
+	}
+	return s.Next.Geocode(ctx, address)
+}
+
+func normalizeAddress(address string) string {
+	return strings.ToLower(strings.Join(strings.Fields(address), " "))
+}
+
+// geocodeAll geocodes every address, failed addresses are left out
+func geocodeAll(ctx context.Context, geo Geocoder, addresses []string) map[string]LatLng {
+	coords := make(map[string]LatLng, len(addresses))
+	for _, a := range addresses {
+		if _, ok := coords[a]; ok {
+			continue
+		}
+		c, err := geo.Geocode(ctx, a)
+		if err != nil {
+			logger.Println("Unable to geocode", a, err)
+			continue
+		}
+		coords[a] = c
+	}
+	return coords
+}
+
+// OSRMDistance uses the table service of an OSRM server
+type OSRMDistance struct {
+	BaseURL  string
+	Profile  string
+	Geocoder Geocoder
+	client   *http.Client
+}
+
+func (o *OSRMDistance) DistanceMatrix(ctx context.Context, origins, destinations []string) (TravelMatrix, error) {
+	m := newTravelMatrix(len(origins), len(destinations))
+	coords := geocodeAll(ctx, o.Geocoder, append(append([]string{}, origins...), destinations...))
+
+	// Only the geocoded addresses are sent, remember where they came from
+	var points []string
+	var sources, dests []string
+	var originIdx, destIdx []int
+	for i, a := range origins {
+		if c, ok := coords[a]; ok {
+			sources = append(sources, strconv.Itoa(len(points)))
+			originIdx = append(originIdx, i)
+			points = append(points, fmt.Sprintf("%f,%f", c.Lng, c.Lat))
+		}
+	}
+	for i, a := range destinations {
+		if c, ok := coords[a]; ok {
+			dests = append(dests, strconv.Itoa(len(points)))
+			destIdx = append(destIdx, i)
+			points = append(points, fmt.Sprintf("%f,%f", c.Lng, c.Lat))
+		}
+	}
+	if len(sources) == 0 || len(dests) == 0 {
+		return m, nil
+	}
+
+	// OSRM expects the separators unescaped
+	u := fmt.Sprintf("%s/table/v1/%s/%s?sources=%s&destinations=%s&annotations=duration,distance",
+		strings.TrimSuffix(o.BaseURL, "/"), url.PathEscape(o.Profile), strings.Join(points, ";"),
+		strings.Join(sources, ";"), strings.Join(dests, ";"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var table struct {
+		Code      string       `json:"code"`
+		Message   string       `json:"message"`
+		Durations [][]*float64 `json:"durations"`
+		Distances [][]*float64 `json:"distances"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&table); err != nil {
+		return nil, err
+	}
+	if table.Code != "Ok" {
+		return nil, fmt.Errorf("osrm returned %v: %v", table.Code, table.Message)
+	}
+	for i, row := range table.Durations {
+		for j, seconds := range row {
+			if seconds == nil || i >= len(originIdx) || j >= len(destIdx) {
+				continue
+			}
+			travel := &Travel{Duration: time.Duration(*seconds * float64(time.Second))}
+			if i < len(table.Distances) && j < len(table.Distances[i]) && table.Distances[i][j] != nil {
+				travel.Meters = int(*table.Distances[i][j])
+			}
+			m[originIdx[i]][destIdx[j]] = travel
+		}
+	}
+	return m, nil
+}
+
+// HaversineDistance estimates travel from the straight line between
+// coordinates, without using any routing service
+type HaversineDistance struct {
+	Geocoder Geocoder
+	// Ratio of road distance to straight line distance
+	DetourFactor float64
+	// Average driving speed in km/h
+	SpeedKmh float64
+}
+
+const earthRadiusMeters = 6371000
+
+func haversine(a, b LatLng) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(b.Lat - a.Lat)
+	dLng := toRad(b.Lng - a.Lng)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(a.Lat))*math.Cos(toRad(b.Lat))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+func (h *HaversineDistance) DistanceMatrix(ctx context.Context, origins, destinations []string) (TravelMatrix, error) {
+	m := newTravelMatrix(len(origins), len(destinations))
+	coords := geocodeAll(ctx, h.Geocoder, append(append([]string{}, origins...), destinations...))
+	for io, or := range origins {
+		from, ok := coords[or]
+		if !ok {
+			continue
+		}
+		for id, dest := range destinations {
+			to, ok := coords[dest]
+			if !ok {
+				continue
+			}
+			meters := haversine(from, to) * h.DetourFactor
+			hours := meters / 1000 / h.SpeedKmh
+			m[io][id] = &Travel{
+				Meters:   int(meters),
+				Duration: time.Duration(hours * float64(time.Hour)),
+			}
+		}
+	}
+	return m, nil
+}
+
+// RoutingConfig selects the distance provider and geocoder
+type RoutingConfig struct {
+	// "google" (default), "osrm" or "haversine"
+	Provider string `json:"provider,omitempty"`
+	// "google", "nominatim" or "none" to only use the known coordinates,
+	// used by osrm and haversine. Defaults to nominatim when its url is
+	// set, so that they run without google unless asked to
+	Geocoder     string `json:"geocoder,omitempty"`
+	OSRMURL      string `json:"osrm_url,omitempty"`
+	OSRMProfile  string `json:"osrm_profile,omitempty"`
+	NominatimURL string `json:"nominatim_url,omitempty"`
+	// Addresses with known coordinates, checked before the geocoder
+	Coordinates  map[string]LatLng `json:"coordinates,omitempty"`
+	DetourFactor float64           `json:"detour_factor,omitempty"`
+	SpeedKmh     float64           `json:"speed_kmh,omitempty"`
+	// Maximum number of concurrent requests of a large matrix
+	Parallelism int `json:"parallelism,omitempty"`
+	// How long distances and geocodes are cached, a week if zero
+	CacheTTLHours int `json:"cache_ttl_hours,omitempty"`
+}
+
+func (r RoutingConfig) validate() error {
+	switch r.Provider {
+	case "", "google", "haversine":
+	case "osrm":
+		if r.OSRMURL == "" {
+			return fmt.Errorf("osrm_url is required for the osrm provider")
+		}
+	default:
+		return fmt.Errorf("unknown distance provider %q", r.Provider)
+	}
+	switch r.Geocoder {
+	case "", "google", "none":
+	case "nominatim":
+		if r.NominatimURL == "" {
+			return fmt.Errorf("nominatim_url is required for the nominatim geocoder")
+		}
+	default:
+		return fmt.Errorf("unknown geocoder %q", r.Geocoder)
+	}
+	if r.DetourFactor < 0 || r.SpeedKmh < 0 || r.Parallelism < 0 || r.CacheTTLHours < 0 {
+		return fmt.Errorf("detour factor, speed, parallelism and cache ttl cannot be negative")
+	}
+	return nil
+}
+
+// geocoder is the configured geocoder or its default
+func (r RoutingConfig) geocoder() string {
+	switch {
+	case r.Geocoder != "":
+		return r.Geocoder
+	case r.NominatimURL != "":
+		return "nominatim"
+	}
+	return "none"
+}
+
+func createGeocoder(cfg RoutingConfig, httpClient *http.Client, cache *Cache) (Geocoder, error) {
+	static := &StaticGeocoder{Known: make(map[string]LatLng, len(cfg.Coordinates))}
+	for a, c := range cfg.Coordinates {
+		static.Known[normalizeAddress(a)] = c
+	}
+	switch cfg.geocoder() {
+	case "none":
+	case "nominatim":
+		static.Next = &NominatimGeocoder{BaseURL: cfg.NominatimURL, client: httpClient}
+	case "google":
+		mapService := createMapService()
+		if mapService == nil {
+			return nil, fmt.Errorf("unable to create the google geocoder")
+		}
+		static.Next = &GoogleGeocoder{client: mapService}
+	}
+	if cache != nil && static.Next != nil {
+		static.Next = &CachedGeocoder{Geocoder: static.Next, cache: cache}
+	}
+	return static, nil
+}
+
+// createDistanceProvider creates the provider selected by the config,
+// results are cached unless cache is nil
+func createDistanceProvider(cfg RoutingConfig, cache *Cache) (DistanceProvider, error) {
+	provider, mode, err := newDistanceProvider(cfg, cache)
+	if err != nil || cache == nil {
+		return provider, err
+	}
+	return &CachedDistance{Provider: provider, Mode: mode, cache: cache}, nil
+}
+
+func newDistanceProvider(cfg RoutingConfig, cache *Cache) (DistanceProvider, string, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, "", err
+	}
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	parallelism := cfg.Parallelism
+	if parallelism == 0 {
+		parallelism = 4
+	}
+	switch cfg.Provider {
+	case "osrm":
+		geo, err := createGeocoder(cfg, httpClient, cache)
+		if err != nil {
+			return nil, "", err
+		}
+		profile := cfg.OSRMProfile
+		if profile == "" {
+			profile = "driving"
+		}
+		// The default max-table-size of osrm-routed is 100 coordinates
+		return &BatchedDistance{
+			Provider:        &OSRMDistance{BaseURL: cfg.OSRMURL, Profile: profile, Geocoder: geo, client: httpClient},
+			MaxOrigins:      50,
+			MaxDestinations: 50,
+			MaxElements:     2500,
+			Parallelism:     parallelism,
+		}, "osrm:" + profile, nil
+	case "haversine":
+		geo, err := createGeocoder(cfg, httpClient, cache)
+		if err != nil {
+			return nil, "", err
+		}
+		detour, speed := cfg.DetourFactor, cfg.SpeedKmh
+		if detour == 0 {
+			detour = 1.3
+		}
+		if speed == 0 {
+			speed = 50
+		}
+		mode := fmt.Sprintf("haversine:%g:%g", detour, speed)
+		return &HaversineDistance{Geocoder: geo, DetourFactor: detour, SpeedKmh: speed}, mode, nil
+	default:
+		mapService := createMapService()
+		if mapService == nil {
+			return nil, "", fmt.Errorf("unable to create the google maps client")
+		}
+		return &BatchedDistance{
+			Provider:        &GoogleDistance{client: mapService},
+			MaxOrigins:      googleMaxOrigins,
+			MaxDestinations: googleMaxDestinations,
+			MaxElements:     googleMaxElements,
+			Parallelism:     parallelism,
+		}, "google:driving", nil
+	}
+}
+
+// Limits of a single Google distance matrix request
+const (
+	googleMaxOrigins      = 25
+	googleMaxDestinations = 25
+	googleMaxElements     = 100
+)
+
+// BatchedDistance splits large matrices into requests that fit the limits
+// of the provider and runs them concurrently
+type BatchedDistance struct {
+	Provider        DistanceProvider
+	MaxOrigins      int
+	MaxDestinations int
+	MaxElements     int
+	// Maximum number of requests in flight
+	Parallelism int
+}
+
+type distanceBatch struct {
+	originStart, destStart int
+	origins, destinations  []string
+}
+
+func (b *BatchedDistance) batches(origins, destinations []string) []distanceBatch {
+	originSize := min(len(origins), b.MaxOrigins)
+	destSize := min(len(destinations), b.MaxDestinations, b.MaxElements/max(originSize, 1))
+	if originSize <= 0 || destSize <= 0 {
+		return nil
+	}
+	var batches []distanceBatch
+	for io := 0; io < len(origins); io += originSize {
+		oEnd := min(io+originSize, len(origins))
+		for id := 0; id < len(destinations); id += destSize {
+			dEnd := min(id+destSize, len(destinations))
+			batches = append(batches, distanceBatch{
+				originStart:  io,
+				destStart:    id,
+				origins:      origins[io:oEnd],
+				destinations: destinations[id:dEnd],
+			})
+		}
+	}
+	return batches
+}
+
+func (b *BatchedDistance) DistanceMatrix(ctx context.Context, origins, destinations []string) (TravelMatrix, error) {
+	batches := b.batches(origins, destinations)
+	if len(batches) == 1 {
+		return b.Provider.DistanceMatrix(ctx, origins, destinations)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	m := newTravelMatrix(len(origins), len(destinations))
+	sem := make(chan struct{}, max(b.Parallelism, 1))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for _, batch := range batches {
+		wg.Add(1)
+		go func(batch distanceBatch) {
+			defer wg.Done()
+			// Batches still waiting are not sent once the search is given up
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-sem }()
+			if ctx.Err() != nil {
+				return
+			}
+
+			part, err := b.Provider.DistanceMatrix(ctx, batch.origins, batch.destinations)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				return
+			}
+			// Each batch fills its own cells of the matrix
+			for io, row := range part {
+				copy(m[batch.originStart+io][batch.destStart:], row)
+			}
+		}(batch)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHaversine(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b LatLng
+		km   float64
+	}{
+		{"same point", LatLng{52.52, 13.405}, LatLng{52.52, 13.405}, 0},
+		{"Berlin to Paris", LatLng{52.52, 13.405}, LatLng{48.8566, 2.3522}, 878},
+		{"a degree of the equator", LatLng{0, 0}, LatLng{0, 1}, 111.2},
+		{"antipodes", LatLng{0, 0}, LatLng{0, 180}, math.Pi * earthRadiusMeters / 1000},
+	}
+	for _, tt := range tests {
+		if got := haversine(tt.a, tt.b) / 1000; math.Abs(got-tt.km) > 1 {
+			t.Errorf("%v: %.1f km, want %.1f", tt.name, got, tt.km)
+		}
+	}
+}
+
+func TestHaversineDistance(t *testing.T) {
+	h := &HaversineDistance{
+		Geocoder:     &StaticGeocoder{Known: map[string]LatLng{"office": {0, 0}}},
+		DetourFactor: 1.5,
+		SpeedKmh:     60,
+	}
+	m, err := h.DistanceMatrix(context.Background(), []string{"Office"}, []string{"0,1", "Nowhere"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := m[0][0]
+	if got == nil || got.Meters < 166000 || got.Meters > 167500 {
+		t.Fatalf("travel %+v, want a degree of the equator with the detour", got)
+	}
+	// The meters are rounded down
+	if want := time.Duration(float64(got.Meters) / 1000 / 60 * float64(time.Hour)); got.Duration-want >= time.Second {
+		t.Errorf("took %v, want %v", got.Duration, want)
+	}
+	if m[0][1] != nil {
+		t.Errorf("travel to an unknown address %+v", m[0][1])
+	}
+}
+
+func TestOSRMDistance(t *testing.T) {
+	var path, query string
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		path, query = req.URL.Path, req.URL.RawQuery
+		json.NewEncoder(rw).Encode(map[string]any{
+			"code":      "Ok",
+			"durations": [][]any{{600, nil}},
+			"distances": [][]any{{9000, nil}},
+		})
+	}))
+	defer srv.Close()
+	o := &OSRMDistance{
+		BaseURL:  srv.URL + "/",
+		Profile:  "driving",
+		Geocoder: &StaticGeocoder{},
+		client:   srv.Client(),
+	}
+	m, err := o.DistanceMatrix(context.Background(), []string{"Nowhere", "1,2"}, []string{"3,4", "5,6"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/table/v1/driving/2.000000,1.000000;4.000000,3.000000;6.000000,5.000000" {
+		t.Errorf("requested %v", path)
+	}
+	if !strings.Contains(query, "sources=0&destinations=1;2") {
+		t.Errorf("requested %v", query)
+	}
+	if m[0][0] != nil || m[0][1] != nil {
+		t.Errorf("travel from an unknown address %+v %+v", m[0][0], m[0][1])
+	}
+	if got := m[1][0]; got == nil || *got != (Travel{Meters: 9000, Duration: 10 * time.Minute}) {
+		t.Errorf("travel %+v, want 9 km in 10 minutes", got)
+	}
+	if m[1][1] != nil {
+		t.Errorf("travel without a route %+v", m[1][1])
+	}
+}
+
+func TestOSRMDistanceError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(rw).Encode(map[string]any{"code": "InvalidQuery", "message": "bad"})
+	}))
+	defer srv.Close()
+	o := &OSRMDistance{BaseURL: srv.URL, Profile: "driving", Geocoder: &StaticGeocoder{}, client: srv.Client()}
+	if _, err := o.DistanceMatrix(context.Background(), []string{"1,2"}, []string{"3,4"}); err == nil {
+		t.Error("no error for a failed table request")
+	}
+}
+
+func TestRoutingGeocoder(t *testing.T) {
+	tests := []struct {
+		cfg  RoutingConfig
+		want string
+	}{
+		{RoutingConfig{Provider: "haversine"}, "none"},
+		{RoutingConfig{Provider: "haversine", NominatimURL: "http://localhost:8080"}, "nominatim"},
+		{RoutingConfig{Provider: "osrm", OSRMURL: "http://localhost:5000"}, "none"},
+		{RoutingConfig{Provider: "haversine", Geocoder: "google"}, "google"},
+		{RoutingConfig{Provider: "osrm", Geocoder: "none", NominatimURL: "http://localhost:8080"}, "none"},
+	}
+	for _, tt := range tests {
+		if got := tt.cfg.geocoder(); got != tt.want {
+			t.Errorf("%+v uses %q, want %q", tt.cfg, got, tt.want)
+		}
+	}
+}
+
+func TestHaversineRunsWithoutGoogle(t *testing.T) {
+	t.Setenv("GOOGLE_MAPS_API_KEY", "")
+	geo, err := createGeocoder(RoutingConfig{Provider: "haversine"}, http.DefaultClient, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := geo.(*StaticGeocoder).Next; next != nil {
+		t.Errorf("falls back to %T", next)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/search" || req.URL.Query().Get("q") != "Main Street 1" {
+			http.NotFound(rw, req)
+			return
+		}
+		rw.Write([]byte(`[{"lat": "52.5", "lon": "13.4"}]`))
+	}))
+	defer srv.Close()
+	geo, err = createGeocoder(RoutingConfig{Provider: "haversine", NominatimURL: srv.URL}, srv.Client(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := geo.Geocode(context.Background(), "Main Street 1")
+	if err != nil || got != (LatLng{52.5, 13.4}) {
+		t.Errorf("geocoded %+v, %v", got, err)
+	}
+}
+
+// blockingDistance answers for the locations of lineDistance, fails for
+// the origin fail, or every origin for "*", and blocks the others until
+// the context is done when block is set
+type blockingDistance struct {
+	lineDistance
+	fail     string
+	block    bool
+	mu       sync.Mutex
+	requests int
+}
+
+func (b *blockingDistance) DistanceMatrix(ctx context.Context, origins, destinations []string) (TravelMatrix, error) {
+	b.mu.Lock()
+	b.requests++
+	b.mu.Unlock()
+	if b.fail == "*" || slices.Contains(origins, b.fail) {
+		return nil, fmt.Errorf("no route from %v", b.fail)
+	}
+	if b.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return b.lineDistance.DistanceMatrix(ctx, origins, destinations)
+}
+
+func TestBatchedDistance(t *testing.T) {
+	places := lineDistance{"A": 1, "B": 2, "C": 4, "D": 8, "E": 16}
+	names := []string{"A", "B", "C", "D", "E"}
+	tests := []struct {
+		name     string
+		batched  BatchedDistance
+		requests int
+	}{
+		{"one request", BatchedDistance{MaxOrigins: 25, MaxDestinations: 25, MaxElements: 100, Parallelism: 4}, 1},
+		{"split origins", BatchedDistance{MaxOrigins: 2, MaxDestinations: 25, MaxElements: 100, Parallelism: 4}, 3},
+		{"split destinations", BatchedDistance{MaxOrigins: 25, MaxDestinations: 3, MaxElements: 100, Parallelism: 1}, 2},
+		{"split by elements", BatchedDistance{MaxOrigins: 25, MaxDestinations: 25, MaxElements: 10, Parallelism: 2}, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := &blockingDistance{lineDistance: places}
+			test.batched.Provider = provider
+			m, err := test.batched.DistanceMatrix(context.Background(), names, names)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if provider.requests != test.requests {
+				t.Errorf("sent %d requests, want %d", provider.requests, test.requests)
+			}
+			want, _ := places.DistanceMatrix(context.Background(), names, names)
+			for i := range names {
+				for j := range names {
+					if m[i][j] == nil || *m[i][j] != *want[i][j] {
+						t.Errorf("%v to %v: got %v, want %v", names[i], names[j], m[i][j], *want[i][j])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestBatchedDistanceCancels(t *testing.T) {
+	names := []string{"A", "B", "C", "D", "E"}
+	tests := []struct {
+		name        string
+		fail        string
+		parallelism int
+		cancel      bool
+		maxRequests int
+	}{
+		{"failure stops the waiting batches", "*", 1, false, 1},
+		{"failure stops the running batches", "E", 5, false, 5},
+		{"canceled search", "", 5, true, 5},
+		{"canceled search stops the waiting batches", "", 1, true, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := &blockingDistance{fail: test.fail, block: true}
+			batched := &BatchedDistance{Provider: provider, MaxOrigins: 1, MaxDestinations: 5, MaxElements: 5, Parallelism: test.parallelism}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if test.cancel {
+				time.AfterFunc(10*time.Millisecond, cancel)
+			}
+			done := make(chan error)
+			go func() {
+				_, err := batched.DistanceMatrix(ctx, names, names)
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if err == nil {
+					t.Error("no error")
+				}
+				if test.cancel && !errors.Is(err, context.Canceled) {
+					t.Errorf("got %v, want the cancellation", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the batches were not canceled")
+			}
+			if provider.requests > test.maxRequests {
+				t.Errorf("sent %d requests, want at most %d", provider.requests, test.maxRequests)
+			}
+		})
+	}
+}
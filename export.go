@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats slots can be exported in
+const (
+	formatJSON     = "json"
+	formatICS      = "ics"
+	formatCSV      = "csv"
+	formatMarkdown = "md"
+)
+
+var formatTypes = map[string]string{
+	formatJSON:     "application/json",
+	formatICS:      "text/calendar; charset=utf-8",
+	formatCSV:      "text/csv; charset=utf-8",
+	formatMarkdown: "text/markdown; charset=utf-8",
+}
+
+// slotFormat picks the export format from the format parameter, or else
+// from the first known type of the Accept header
+func slotFormat(req *http.Request) (string, error) {
+	if f := strings.ToLower(req.URL.Query().Get("format")); f != "" {
+		if f == "markdown" {
+			f = formatMarkdown
+		}
+		if _, ok := formatTypes[f]; !ok {
+			return "", fmt.Errorf("unknown format %q, use json, ics, csv or md", f)
+		}
+		return f, nil
+	}
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/json":
+			return formatJSON, nil
+		case "text/calendar":
+			return formatICS, nil
+		case "text/csv":
+			return formatCSV, nil
+		case "text/markdown":
+			return formatMarkdown, nil
+		}
+	}
+	return formatJSON, nil
+}
+
+// exportSlots writes the slots in one of the text formats, times are
+// shown in loc
+func exportSlots(format string, slots []LocatedTimeSlot, eventLoc string, loc *time.Location) ([]byte, error) {
+	switch format {
+	case formatICS:
+		return slotsICS(slots, eventLoc), nil
+	case formatCSV:
+		return slotsCSV(slots, loc)
+	case formatMarkdown:
+		return slotsMarkdown(slots, loc), nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+// writeExport answers with the slots in one of the text formats
+func writeExport(rw http.ResponseWriter, format string, slots []LocatedTimeSlot, eventLoc string, loc *time.Location) {
+	b, err := exportSlots(format, slots, eventLoc, loc)
+	if err != nil {
+		http.Error(rw, "Unable to export available spots", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", formatTypes[format])
+	rw.Header().Set("Content-Disposition", "inline; filename=\"slots."+format+"\"")
+	rw.Write(b)
+}
+
+// slotsICS makes a calendar with a tentative event for each slot
+func slotsICS(slots []LocatedTimeSlot, eventLoc string) []byte {
+	var b bytes.Buffer
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	writeICSLine(&b, "BEGIN:VCALENDAR")
+	writeICSLine(&b, "VERSION:2.0")
+	writeICSLine(&b, "PRODID:-//calendargo//Available slots//EN")
+	writeICSLine(&b, "METHOD:PUBLISH")
+	for _, slot := range slots {
+		writeICSLine(&b, "BEGIN:VEVENT")
+		writeICSLine(&b, "UID:"+slot.ID+"@calendargo")
+		writeICSLine(&b, "DTSTAMP:"+stamp)
+		writeICSLine(&b, "DTSTART:"+slot.Start.UTC().Format("20060102T150405Z"))
+		writeICSLine(&b, "DTEND:"+slot.End.UTC().Format("20060102T150405Z"))
+		writeICSLine(&b, "SUMMARY:"+escapeICSText("Available: "+eventLoc))
+		writeICSLine(&b, "LOCATION:"+escapeICSText(eventLoc))
+		writeICSLine(&b, "DESCRIPTION:"+escapeICSText(slotNeighbors(slot)))
+		writeICSLine(&b, "STATUS:TENTATIVE")
+		writeICSLine(&b, "END:VEVENT")
+	}
+	writeICSLine(&b, "END:VCALENDAR")
+	return b.Bytes()
+}
+
+// writeICSLine ends the line with CRLF, folding it after 75 octets
+// without splitting characters
+func writeICSLine(b *bytes.Buffer, line string) {
+	n := 0
+	for _, r := range line {
+		size := len(string(r))
+		if n+size > 75 {
+			b.WriteString("\r\n ")
+			n = 1
+		}
+		b.WriteRune(r)
+		n += size
+	}
+	b.WriteString("\r\n")
+}
+
+func escapeICSText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(s)
+}
+
+func slotNeighbors(slot LocatedTimeSlot) string {
+	parts := []string{
+		fmt.Sprintf("Distance: %.1f km", float64(slot.Distance)/1000),
+		fmt.Sprintf("Detour: %d min", int(slot.Detour.Minutes())),
+		fmt.Sprintf("Score: %.2f", slot.Score.Total),
+	}
+	if slot.ComesAfter.Summary != "" {
+		parts = append(parts, "After: "+describeEvent(slot.ComesAfter))
+	}
+	if slot.ComesBefore.Summary != "" {
+		parts = append(parts, "Before: "+describeEvent(slot.ComesBefore))
+	}
+	return strings.Join(parts, "\n")
+}
+
+func formatScore(v float64) string {
+	return strconv.FormatFloat(v, 'f', 3, 64)
+}
+
+func describeEvent(e Event) string {
+	if e.Location == "" {
+		return e.Summary
+	}
+	return e.Summary + " (" + e.Location + ")"
+}
+
+// csvText keeps spreadsheets from reading the text as a formula
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func slotsCSV(slots []LocatedTimeSlot, loc *time.Location) ([]byte, error) {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Write([]string{"id", "start", "end", "distance_m", "travel_in_min", "travel_out_min", "buffer_in_min", "buffer_out_min", "detour_min",
+		"score", "score_travel", "score_time_of_day", "score_proximity", "score_fragmentation", "score_buffer",
+		"comes_after", "comes_after_location", "comes_before", "comes_before_location"})
+	for _, slot := range slots {
+		w.Write([]string{
+			slot.ID,
+			slot.Start.In(loc).Format(time.RFC3339),
+			slot.End.In(loc).Format(time.RFC3339),
+			strconv.Itoa(slot.Distance),
+			strconv.Itoa(int(slot.TravelIn.Minutes())),
+			strconv.Itoa(int(slot.TravelOut.Minutes())),
+			strconv.Itoa(int(slot.BufferIn.Minutes())),
+			strconv.Itoa(int(slot.BufferOut.Minutes())),
+			strconv.Itoa(int(slot.Detour.Minutes())),
+			formatScore(slot.Score.Total),
+			formatScore(slot.Score.Travel),
+			formatScore(slot.Score.TimeOfDay),
+			formatScore(slot.Score.Proximity),
+			formatScore(slot.Score.Fragmentation),
+			formatScore(slot.Score.Buffer),
+			csvText(slot.ComesAfter.Summary),
+			csvText(slot.ComesAfter.Location),
+			csvText(slot.ComesBefore.Summary),
+			csvText(slot.ComesBefore.Location),
+		})
+	}
+	w.Flush()
+	return b.Bytes(), w.Error()
+}
+
+// slotsMarkdown lists the slots under a heading for each day, in time order
+func slotsMarkdown(slots []LocatedTimeSlot, loc *time.Location) []byte {
+	sorted := slices.Clone(slots)
+	slices.SortFunc(sorted, func(i, j LocatedTimeSlot) int {
+		return i.Start.Compare(j.Start)
+	})
+	var b bytes.Buffer
+	if len(sorted) == 0 {
+		b.WriteString("No available slots\n")
+		return b.Bytes()
+	}
+	var day Date
+	for i, slot := range sorted {
+		start, end := slot.Start.In(loc), slot.End.In(loc)
+		if d := TimeToDate(start); i == 0 || d != day {
+			if i > 0 {
+				b.WriteString("\n")
+			}
+			day = d
+			fmt.Fprintf(&b, "## %v\n\n", start.Format("Monday, January 2, 2006"))
+		}
+		fmt.Fprintf(&b, "- **%v–%v** · %.1f km · +%d min · score %.2f", start.Format("15:04"), end.Format("15:04"), float64(slot.Distance)/1000, int(slot.Detour.Minutes()), slot.Score.Total)
+		if slot.ComesAfter.Summary != "" {
+			fmt.Fprintf(&b, " · after %v", markdownText(describeEvent(slot.ComesAfter)))
+		}
+		if slot.ComesBefore.Summary != "" {
+			fmt.Fprintf(&b, " · before %v", markdownText(describeEvent(slot.ComesBefore)))
+		}
+		b.WriteString("\n")
+	}
+	return b.Bytes()
+}
+
+// markdownText escapes the characters that would format the text
+func markdownText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`, "\n", " ").Replace(s)
+}
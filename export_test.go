@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func exportTestSlots() []LocatedTimeSlot {
+	start := time.Date(2030, 1, 7, 9, 0, 0, 0, time.UTC)
+	return []LocatedTimeSlot{
+		{
+			TimeSlot: TimeSlot{
+				Start:       start.Add(25 * time.Hour),
+				End:         start.Add(26 * time.Hour),
+				ComesAfter:  Event{Summary: "=HYPERLINK(\"x\")", Location: "+31 Main St"},
+				ComesBefore: Event{Summary: "Review, part *two*", Location: "Office"},
+			},
+			ID:       "b",
+			Distance: 2500,
+			Detour:   15 * time.Minute,
+			Score:    SlotScore{Total: 0.5},
+		},
+		{
+			TimeSlot: TimeSlot{Start: start, End: start.Add(time.Hour)},
+			ID:       "a",
+		},
+	}
+}
+
+func TestSlotFormat(t *testing.T) {
+	tests := []struct {
+		query, accept string
+		want          string
+		fails         bool
+	}{
+		{"", "", formatJSON, false},
+		{"format=ics", "", formatICS, false},
+		{"format=markdown", "", formatMarkdown, false},
+		{"format=CSV", "application/json", formatCSV, false},
+		{"format=xml", "", "", true},
+		{"", "text/html, text/csv;q=0.9", formatCSV, false},
+		{"", "text/calendar; charset=utf-8", formatICS, false},
+		{"", "*/*", formatJSON, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/availableSlots?"+tt.query, nil)
+		req.Header.Set("Accept", tt.accept)
+		got, err := slotFormat(req)
+		if (err != nil) != tt.fails || got != tt.want {
+			t.Errorf("%q, Accept %q: got %q, %v", tt.query, tt.accept, got, err)
+		}
+	}
+}
+
+func TestCSVText(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"", ""},
+		{"Lunch", "Lunch"},
+		{"=1+1", "'=1+1"},
+		{"+31 Main St", "'+31 Main St"},
+		{"-5", "'-5"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\tTab", "'\tTab"},
+		{"a=b", "a=b"},
+	}
+	for _, tt := range tests {
+		if got := csvText(tt.in); got != tt.want {
+			t.Errorf("csvText(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSlotsCSV(t *testing.T) {
+	b, err := slotsCSV(exportTestSlots(), time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(strings.NewReader(string(b))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("%d rows, want a header and two slots", len(rows))
+	}
+	row := rows[1]
+	want := map[int]string{
+		0:  "b",
+		1:  "2030-01-08T10:00:00Z",
+		3:  "2500",
+		8:  "15",
+		9:  "0.500",
+		15: "'=HYPERLINK(\"x\")",
+		16: "'+31 Main St",
+		17: "Review, part *two*",
+	}
+	for i, v := range want {
+		if row[i] != v {
+			t.Errorf("column %v is %q, want %q", rows[0][i], row[i], v)
+		}
+	}
+}
+
+func TestSlotsICS(t *testing.T) {
+	out := string(slotsICS(exportTestSlots(), "Client; Building 2, with a long name that needs folding"))
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("line of %d octets: %q", len(line), line)
+		}
+	}
+	unfolded := strings.ReplaceAll(out, "\r\n ", "")
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"UID:b@calendargo\r\n",
+		"DTSTART:20300108T100000Z\r\n",
+		"DTEND:20300107T100000Z\r\n",
+		"LOCATION:Client\\; Building 2\\, with a long name that needs folding\r\n",
+		"Before: Review\\, part *two* (Office)",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(unfolded, want) {
+			t.Errorf("missing %q in\n%v", want, unfolded)
+		}
+	}
+	if n := strings.Count(out, "BEGIN:VEVENT"); n != 2 {
+		t.Errorf("%d events, want 2", n)
+	}
+}
+
+func TestSlotsMarkdown(t *testing.T) {
+	loc := time.FixedZone("UTC+1", 60*60)
+	got := string(slotsMarkdown(exportTestSlots(), loc))
+	want := "## Monday, January 7, 2030\n\n" +
+		"- **10:00–11:00** · 0.0 km · +0 min · score 0.00\n" +
+		"\n## Tuesday, January 8, 2030\n\n" +
+		"- **11:00–12:00** · 2.5 km · +15 min · score 0.50 · after =HYPERLINK(\"x\") (+31 Main St) · before Review, part \\*two\\* (Office)\n"
+	if got != want {
+		t.Errorf("got\n%v\nwant\n%v", got, want)
+	}
+	if got := string(slotsMarkdown(nil, loc)); got != "No available slots\n" {
+		t.Errorf("without slots: %q", got)
+	}
+}
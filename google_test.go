@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/option"
+)
+
+// pagedCalendarAPI serves n events and n calendars, pages of the
+// requested size linked by the offset as page token
+type pagedCalendarAPI struct {
+	n        int
+	requests int
+	sizes    []string
+}
+
+func (p *pagedCalendarAPI) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	p.requests++
+	q := req.URL.Query()
+	p.sizes = append(p.sizes, q.Get("maxResults"))
+	size, _ := strconv.Atoi(q.Get("maxResults"))
+	offset, _ := strconv.Atoi(q.Get("pageToken"))
+	end := min(offset+size, p.n)
+	next := ""
+	if end < p.n {
+		next = strconv.Itoa(end)
+	}
+	var items []map[string]any
+	for i := offset; i < end; i++ {
+		start := time.Date(2030, 1, 7, 9, 0, 0, 0, time.UTC).Add(time.Duration(i) * time.Hour)
+		items = append(items, map[string]any{
+			"id":      strconv.Itoa(i),
+			"summary": "Item " + strconv.Itoa(i),
+			"start":   map[string]string{"dateTime": start.Format(time.RFC3339)},
+			"end":     map[string]string{"dateTime": start.Add(30 * time.Minute).Format(time.RFC3339)},
+		})
+	}
+	json.NewEncoder(rw).Encode(map[string]any{"items": items, "nextPageToken": next})
+}
+
+func testGoogleSource(t *testing.T, api http.Handler, pageSize int64, maxPages int) *GoogleSource {
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	svc, err := calendar.NewService(context.Background(), option.WithEndpoint(srv.URL+"/"), option.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewGoogleSource(svc, pageSize, maxPages)
+}
+
+func TestGoogleSourcePaging(t *testing.T) {
+	tests := []struct {
+		name      string
+		n         int
+		maxPages  int
+		want      int
+		requests  int
+		truncated bool
+	}{
+		{"empty", 0, 3, 0, 1, false},
+		{"one page", 2, 3, 2, 1, false},
+		{"every page", 5, 3, 5, 3, false},
+		{"full last page", 6, 3, 6, 3, false},
+		{"cut off", 7, 3, 6, 3, true},
+	}
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &pagedCalendarAPI{n: tt.n}
+			src := testGoogleSource(t, api, 2, tt.maxPages)
+			timeMin := time.Date(2030, 1, 7, 0, 0, 0, 0, time.UTC)
+			events, truncated, err := src.ListEvents(ctx, "primary", timeMin, timeMin.AddDate(0, 0, 7))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != tt.want || truncated != tt.truncated || api.requests != tt.requests {
+				t.Errorf("events: got %d, truncated %v in %d requests", len(events), truncated, api.requests)
+			}
+			if strings.Join(api.sizes, ",") != strings.TrimSuffix(strings.Repeat("2,", tt.requests), ",") {
+				t.Errorf("page sizes %v", api.sizes)
+			}
+
+			api.requests = 0
+			cals, truncated, err := src.ListCalendars(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cals) != tt.want || truncated != tt.truncated || api.requests != tt.requests {
+				t.Errorf("calendars: got %d, truncated %v in %d requests", len(cals), truncated, api.requests)
+			}
+		})
+	}
+}
+
+func TestFindSlotsReportsTruncatedCalendars(t *testing.T) {
+	mem := NewMemorySource()
+	mem.Add("cal", "Cal")
+	src := &MultiSource{
+		Default:  testGoogleSource(t, &pagedCalendarAPI{n: 50}, 2, 1),
+		Prefixed: map[string]EventSource{"memory:": mem},
+	}
+	opts := testOpts(src, 30*time.Minute)
+	opts.ids = []string{"primary", "memory:cal"}
+	results, err := findSlots(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results.Truncated) != 1 || results.Truncated[0] != "primary" {
+		t.Errorf("truncated %v, want the primary calendar", results.Truncated)
+	}
+	b, err := json.Marshal(results)
+	if err != nil || !strings.Contains(string(b), `"Truncated":["primary"]`) {
+		t.Errorf("truncation is not in the body %s, %v", b, err)
+	}
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+const (
+	// Every set of participants is searched, so the size is kept small
+	maxParticipants = 8
+	groupLifetime   = 24 * time.Hour
+)
+
+// Participant is a logged in user whose calendars take part in a group
+type Participant struct {
+	Name string
+	// Calendars of the participant, the primary calendar if empty
+	CalIds  []string
+	session SessionToken
+}
+
+// Group is a set of users looking for slots together. Its id is the
+// invitation, anyone logged in who knows it can join
+type Group struct {
+	ID           string
+	Participants []Participant
+	Expires      time.Time
+}
+
+func (g *Group) member(session SessionToken) int {
+	for i, p := range g.Participants {
+		if p.session == session {
+			return i
+		}
+	}
+	return -1
+}
+
+func (g *Group) copy() Group {
+	c := *g
+	c.Participants = slices.Clone(g.Participants)
+	return c
+}
+
+var errGroupNotFound = errors.New("group not found")
+
+// Groups keeps the groups in memory until they expire
+type Groups struct {
+	mu     sync.Mutex
+	groups map[string]*Group
+}
+
+func NewGroups() *Groups {
+	return &Groups{groups: make(map[string]*Group)}
+}
+
+// Create starts a group with the creator as its first participant
+func (g *Groups) Create(creator Participant) (Group, error) {
+	id := randState()
+	if id == "" {
+		return Group{}, fmt.Errorf("unable to create a group id")
+	}
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for id, group := range g.groups {
+		if !now.Before(group.Expires) {
+			delete(g.groups, id)
+		}
+	}
+	group := &Group{ID: id, Participants: []Participant{creator}, Expires: now.Add(groupLifetime)}
+	g.groups[id] = group
+	return group.copy(), nil
+}
+
+// Join adds the participant to the group, or updates them if they already joined
+func (g *Groups) Join(id string, p Participant) (Group, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	group, ok := g.groups[id]
+	if !ok || !time.Now().Before(group.Expires) {
+		return Group{}, errGroupNotFound
+	}
+	i := group.member(p.session)
+	for j, other := range group.Participants {
+		if j != i && other.Name == p.Name {
+			return Group{}, fmt.Errorf("the name %q is already taken", p.Name)
+		}
+	}
+	if i >= 0 {
+		group.Participants[i] = p
+		return group.copy(), nil
+	}
+	if len(group.Participants) == maxParticipants {
+		return Group{}, fmt.Errorf("a group has at most %d participants", maxParticipants)
+	}
+	group.Participants = append(group.Participants, p)
+	return group.copy(), nil
+}
+
+// Leave removes the user from the group, the group ends with its last participant
+func (g *Groups) Leave(id string, session SessionToken) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	group, ok := g.groups[id]
+	if !ok {
+		return errGroupNotFound
+	}
+	i := group.member(session)
+	if i < 0 {
+		return errGroupNotFound
+	}
+	group.Participants = slices.Delete(group.Participants, i, i+1)
+	if len(group.Participants) == 0 {
+		delete(g.groups, id)
+	}
+	return nil
+}
+
+// Get returns the group if the user is one of its participants
+func (g *Groups) Get(id string, session SessionToken) (Group, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	group, ok := g.groups[id]
+	if !ok || !time.Now().Before(group.Expires) || group.member(session) < 0 {
+		return Group{}, false
+	}
+	return group.copy(), true
+}
+
+// GroupMember is a participant along with the source of their calendars
+type GroupMember struct {
+	Participant
+	source EventSource
+}
+
+// GroupSlot is a slot along with who is free for it
+type GroupSlot struct {
+	LocatedTimeSlot
+	Free []string
+	Busy []string
+}
+
+type GroupResults struct {
+	Slots []GroupSlot
+	// Calendars that were cut off, as participant:calendar
+	Truncated []string
+}
+
+// groupCandidate is a free slot of a set of participants, given as a bitmask
+type groupCandidate struct {
+	free uint
+	slot TimeSlot
+	// Merged schedule of the set on the day of the slot, without the
+	// locations of the other members' events
+	sch *Schedule
+}
+
+// findGroupSlots finds the slots where at least minFree of the members are
+// free. Each set of members is searched on its own, and a slot is dropped
+// when a larger set is free for all of it as well. The requester only sees
+// what the other members' neighboring events are called, and how far
+// away they are, when they are their own
+func findGroupSlots(opts Opts, members []GroupMember, minFree int, requester SessionToken) (GroupResults, error) {
+	loc, startDate, endDate := searchDays(opts)
+
+	memberEvents := make([][]*calendar.Event, len(members))
+	// Events of the requester, the schedules hold the same pointers
+	own := make(map[*calendar.Event]bool)
+	var truncated []string
+	for i, m := range members {
+		ids := m.CalIds
+		if len(ids) == 0 {
+			ids = []string{"primary"}
+		}
+		events, cut, err := retrieveEvents(opts.ctx, startDate.In(loc), opts.numDays, ids, m.source, opts.freeBusy, opts.buffers)
+		if err != nil {
+			return GroupResults{}, fmt.Errorf("unable to retrieve the events of %v: %w", m.Name, err)
+		}
+		for _, id := range cut {
+			truncated = append(truncated, m.Name+":"+id)
+		}
+		memberEvents[i] = events
+		if m.session == requester {
+			for _, e := range events {
+				own[e] = true
+			}
+		}
+	}
+
+	var candidates []groupCandidate
+	for free := uint(1); free < 1<<len(members); free++ {
+		if bits.OnesCount(free) < minFree {
+			continue
+		}
+		var events []*calendar.Event
+		for i := range members {
+			if free&(1<<i) != 0 {
+				events = append(events, memberEvents[i]...)
+			}
+		}
+		days := groupEventsByDay(events, opts.busy, loc)
+		for _, slot := range days.FindAvailableTimeSlots(startDate, endDate, opts.duration, opts.hours, loc) {
+			sch := days[slot.Date]
+			slot.ComesAfter = anonymize(slot.ComesAfter, &sch, slot.from, own)
+			slot.ComesBefore = anonymize(slot.ComesBefore, &sch, slot.to, own)
+			sch = hideLocations(sch, own)
+			candidates = append(candidates, groupCandidate{free, slot, &sch})
+		}
+	}
+	candidates = dropCovered(candidates)
+
+	foundEvents := make([]TimeSlot, len(candidates))
+	for i, c := range candidates {
+		foundEvents[i] = c.slot
+	}
+	travel, err := slotTravel(opts, foundEvents)
+	if err != nil {
+		return GroupResults{}, err
+	}
+	slots := make([]GroupSlot, 0, len(candidates))
+	for _, c := range candidates {
+		located, ok := travel.locate(c.slot, c.sch, opts)
+		if !ok {
+			continue
+		}
+		free, busy := []string{}, []string{}
+		for i, m := range members {
+			if c.free&(1<<i) != 0 {
+				free = append(free, m.Name)
+			} else {
+				busy = append(busy, m.Name)
+			}
+		}
+		for _, candidate := range splitSlot(located, opts) {
+			candidate.Score = scoreSlot(candidate, startDate, opts)
+			slots = append(slots, GroupSlot{LocatedTimeSlot: candidate, Free: free, Busy: busy})
+		}
+	}
+
+	// The slots the most people are free for come first, then the best scores
+	slices.SortFunc(slots, func(i, j GroupSlot) int {
+		if len(i.Free) != len(j.Free) {
+			return len(j.Free) - len(i.Free)
+		}
+		if c := compareScores(i.LocatedTimeSlot, j.LocatedTimeSlot); c != 0 {
+			return c
+		}
+		return i.Start.Compare(j.Start)
+	})
+	slots = capPerDay(slots, opts.perDay, func(s GroupSlot) Date { return s.Date })
+	return GroupResults{Slots: slots, Truncated: truncated}, nil
+}
+
+// anonymize hides the neighbor at index i of the schedule when it is an
+// event of another member, it only shows that they are busy
+func anonymize(neighbor Event, sch *Schedule, i int, own map[*calendar.Event]bool) Event {
+	if i < 0 || i >= len(sch.Events) || own[sch.Events[i]] {
+		return neighbor
+	}
+	return Event{Summary: busySummary}
+}
+
+// hideLocations leaves out where the events of the other members are, so
+// the travel around the slots only comes from the requester's own events
+func hideLocations(sch Schedule, own map[*calendar.Event]bool) Schedule {
+	events := make([]*calendar.Event, len(sch.Events))
+	for i, e := range sch.Events {
+		if !own[e] && e.Location != "" {
+			hidden := *e
+			hidden.Location = ""
+			e = &hidden
+		}
+		events[i] = e
+	}
+	return Schedule{Events: events}
+}
+
+// dropCovered removes the slots of a set when a larger set is free for
+// the whole window too. The slots are swept by start, remembering the
+// latest end each set reached so far
+func dropCovered(candidates []groupCandidate) []groupCandidate {
+	sorted := slices.Clone(candidates)
+	slices.SortStableFunc(sorted, func(a, b groupCandidate) int {
+		return a.slot.Start.Compare(b.slot.Start)
+	})
+	reach := make(map[uint]time.Time)
+	var kept []groupCandidate
+	for i := 0; i < len(sorted); {
+		// Slots starting together can cover each other
+		j := i
+		for ; j < len(sorted) && sorted[j].slot.Start.Equal(sorted[i].slot.Start); j++ {
+			if end := sorted[j].slot.End; end.After(reach[sorted[j].free]) {
+				reach[sorted[j].free] = end
+			}
+		}
+		for _, c := range sorted[i:j] {
+			covered := false
+			for free, end := range reach {
+				if free != c.free && free&c.free == c.free && !end.Before(c.slot.End) {
+					covered = true
+					break
+				}
+			}
+			if !covered {
+				kept = append(kept, c)
+			}
+		}
+		i = j
+	}
+	return kept
+}
+
+// GroupQuery is the body of a /groupSlots request, the calendars come
+// from the participants instead of CalIds
+type GroupQuery struct {
+	Query
+	GroupID string
+	// How many participants have to be free, all of them if zero
+	MinFree int
+}
+
+// GroupJoin is the body of the /groups requests
+type GroupJoin struct {
+	// Unused when creating a group
+	GroupID string
+	Name    string
+	CalIds  []string
+}
+
+// newParticipant checks the participant a user joins a group as
+func newParticipant(session SessionToken, join GroupJoin) (Participant, error) {
+	name := strings.TrimSpace(join.Name)
+	if name == "" {
+		return Participant{}, fmt.Errorf("no name given")
+	}
+	return Participant{Name: name, CalIds: join.CalIds, session: session}, nil
+}
+
+// groups returns a group of the user on GET and creates one on POST
+func groups(ss ServerState) func(rw http.ResponseWriter, req *http.Request) {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		token, _, ok := ss.userSource(rw, req)
+		if !ok {
+			return
+		}
+		var group Group
+		switch req.Method {
+		case http.MethodGet:
+			group, ok = ss.groups.Get(req.URL.Query().Get("id"), token)
+			if !ok {
+				http.Error(rw, errGroupNotFound.Error(), http.StatusNotFound)
+				return
+			}
+		case http.MethodPost:
+			defer req.Body.Close()
+			join := GroupJoin{}
+			if err := json.NewDecoder(req.Body).Decode(&join); err != nil {
+				http.Error(rw, "Please provide yourself in the body of the request in the following format: {\"Name\": \"Alex\", \"CalIds\": [\"primary\"]}\n", http.StatusBadRequest)
+				return
+			}
+			p, err := newParticipant(token, join)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			group, err = ss.groups.Create(p)
+			if err != nil {
+				http.Error(rw, "Unable to create the group", http.StatusInternalServerError)
+				logger.Println("Unable to create the group", err)
+				return
+			}
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(http.StatusCreated)
+			json.NewEncoder(rw).Encode(group)
+			return
+		default:
+			http.Error(rw, "Only GET and POST are allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(group)
+	}
+}
+
+func joinGroup(ss ServerState) func(rw http.ResponseWriter, req *http.Request) {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(rw, "Only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token, _, ok := ss.userSource(rw, req)
+		if !ok {
+			return
+		}
+		defer req.Body.Close()
+
+		join := GroupJoin{}
+		if err := json.NewDecoder(req.Body).Decode(&join); err != nil || join.GroupID == "" {
+			http.Error(rw, "Please provide the group in the body of the request in the following format: {\"GroupID\": \"...\", \"Name\": \"Alex\", \"CalIds\": [\"primary\"]}\n", http.StatusBadRequest)
+			return
+		}
+		p, err := newParticipant(token, join)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		group, err := ss.groups.Join(join.GroupID, p)
+		if errors.Is(err, errGroupNotFound) {
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusConflict)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(group)
+	}
+}
+
+func leaveGroup(ss ServerState) func(rw http.ResponseWriter, req *http.Request) {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(rw, "Only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token, ok := ss.sessionID(req)
+		if !ok {
+			http.Error(rw, "No session cookie found", http.StatusUnauthorized)
+			return
+		}
+		defer req.Body.Close()
+
+		join := GroupJoin{}
+		if err := json.NewDecoder(req.Body).Decode(&join); err != nil || join.GroupID == "" {
+			http.Error(rw, "Please provide the group in the body of the request in the following format: {\"GroupID\": \"...\"}\n", http.StatusBadRequest)
+			return
+		}
+		if err := ss.groups.Leave(join.GroupID, token); err != nil {
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func queryGroupSlots(ss ServerState) func(rw http.ResponseWriter, req *http.Request) {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		token, source, ok := ss.userSource(rw, req)
+		if !ok {
+			return
+		}
+		defer req.Body.Close()
+
+		query := GroupQuery{}
+		if err := json.NewDecoder(req.Body).Decode(&query); err != nil {
+			http.Error(rw, "Please provide the query in the body of the request in the following format: {\"GroupID\": \"...\", \"MinFree\": 2, \"NumDays\": 5, \"EventLoc\": \"New York\", \"StartLoc\": \"San Francisco\", \"Duration\": 60}\n", http.StatusBadRequest)
+			logger.Println("Unable to decode group query")
+			return
+		}
+		// The duration is in minutes
+		query.Duration *= time.Minute
+
+		if err := query.validateSearch(); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		format, err := slotFormat(req)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusNotAcceptable)
+			return
+		}
+		group, ok := ss.groups.Get(query.GroupID, token)
+		if !ok {
+			http.Error(rw, errGroupNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		minFree := query.MinFree
+		if minFree == 0 {
+			minFree = len(group.Participants)
+		}
+		if minFree < 1 || minFree > len(group.Participants) {
+			http.Error(rw, fmt.Sprintf("MinFree must be between 1 and %d", len(group.Participants)), http.StatusBadRequest)
+			return
+		}
+
+		// Every participant's calendars are read with their own session
+		members := make([]GroupMember, 0, len(group.Participants))
+		var loggedOut []string
+		for _, p := range group.Participants {
+			memberSource := source
+			if p.session != token {
+				memberSource, ok = ss.sourceFor(p.session)
+				if !ok {
+					loggedOut = append(loggedOut, p.Name)
+					continue
+				}
+			}
+			members = append(members, GroupMember{Participant: p, source: memberSource})
+		}
+		if len(loggedOut) > 0 {
+			http.Error(rw, "These participants have to log in again: "+strings.Join(loggedOut, ", "), http.StatusConflict)
+			return
+		}
+
+		opts, err := ss.slotOpts(source, query.Query)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		results, err := findGroupSlots(opts, members, minFree, token)
+		if err != nil {
+			http.Error(rw, "Unable to find available spots: "+err.Error(), http.StatusInternalServerError)
+			logger.Println("Unable to find group spots", err)
+			return
+		}
+
+		if len(results.Truncated) > 0 {
+			rw.Header().Set(truncatedHeader, strings.Join(results.Truncated, ","))
+		}
+		rw.Header().Add("Vary", "Accept")
+		if format != formatJSON {
+			slots := make([]LocatedTimeSlot, len(results.Slots))
+			for i, s := range results.Slots {
+				slots[i] = s.LocatedTimeSlot
+			}
+			writeExport(rw, format, slots, query.EventLoc, opts.loc)
+			return
+		}
+		b, err := json.Marshal(results)
+		if err != nil {
+			http.Error(rw, "Unable to marshal available spots", http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write(b)
+	}
+}
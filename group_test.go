@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+// lineDistance places every address on a line, at its kilometer, and
+// travels a kilometer a minute
+type lineDistance map[string]int
+
+func (l lineDistance) DistanceMatrix(ctx context.Context, origins, destinations []string) (TravelMatrix, error) {
+	m := make(TravelMatrix, len(origins))
+	for i, o := range origins {
+		m[i] = make([]*Travel, len(destinations))
+		for j, d := range destinations {
+			km := max(l[o]-l[d], l[d]-l[o])
+			m[i][j] = &Travel{Meters: km * 1000, Duration: time.Duration(km) * time.Minute}
+		}
+	}
+	return m, nil
+}
+
+// testOpts searches tomorrow, from 9:00 to 17:00 in UTC
+func testOpts(source EventSource, duration time.Duration) Opts {
+	hours := WorkingHours{}
+	for wd := time.Sunday; wd <= time.Saturday; wd++ {
+		hours[wd] = []TimeRange{{Start: 9 * 60, End: 17 * 60}}
+	}
+	return Opts{
+		ctx:       context.Background(),
+		source:    source,
+		distances: lineDistance{},
+		numDays:   1,
+		duration:  duration,
+		eventLoc:  "Office",
+		startLoc:  "Home",
+		ids:       []string{"primary"},
+		hours:     hours,
+		loc:       time.UTC,
+		weights:   DefaultScoreWeights(),
+	}
+}
+
+// tomorrowAt is the time of day tomorrow in UTC
+func tomorrowAt(hour, minute int) time.Time {
+	day := time.Now().UTC().AddDate(0, 0, 1)
+	return time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, time.UTC)
+}
+
+func testEvent(summary, location string, start, end time.Time) *calendar.Event {
+	return &calendar.Event{
+		Summary:  summary,
+		Location: location,
+		Start:    eventDateTime(start, time.UTC),
+		End:      eventDateTime(end, time.UTC),
+	}
+}
+
+func TestGroupSlotsHideOtherMembersEvents(t *testing.T) {
+	alice, bob := NewMemorySource(), NewMemorySource()
+	alice.Add("primary", "Alice", testEvent("Dentist", "Main Street", tomorrowAt(10, 0), tomorrowAt(11, 0)))
+	bob.Add("primary", "Bob", testEvent("Therapy", "Oak Avenue", tomorrowAt(13, 0), tomorrowAt(14, 0)))
+	members := []GroupMember{
+		{Participant{Name: "Alice", session: "alice"}, alice},
+		{Participant{Name: "Bob", session: "bob"}, bob},
+	}
+
+	opts := testOpts(alice, 30*time.Minute)
+	opts.distances = lineDistance{"Main Street": 3, "Oak Avenue": 40}
+	results, err := findGroupSlots(opts, members, 2, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results.Slots) == 0 {
+		t.Fatal("no slots found")
+	}
+	sawOwn, sawBusy := false, false
+	for _, s := range results.Slots {
+		for _, e := range []Event{s.ComesAfter, s.ComesBefore} {
+			if strings.Contains(e.Summary, "Therapy") || e.Location == "Oak Avenue" {
+				t.Errorf("slot at %v shows the event of another member: %+v", s.Start, e)
+			}
+			sawOwn = sawOwn || e.Summary == "Dentist"
+			sawBusy = sawBusy || e.Summary == busySummary
+		}
+		// Bob's event is the only one 40 km away
+		if s.Distance >= 40000 || s.Detour >= 40*time.Minute || s.TravelIn >= 40*time.Minute || s.TravelOut >= 40*time.Minute {
+			t.Errorf("slot at %v shows how far the event of another member is: %+v", s.Start, s.LocatedTimeSlot)
+		}
+	}
+	if !sawOwn || !sawBusy {
+		t.Errorf("expected the requester's own event and an anonymous one, own %v busy %v", sawOwn, sawBusy)
+	}
+}
+
+func TestDropCovered(t *testing.T) {
+	slot := func(free uint, from, to int) groupCandidate {
+		return groupCandidate{free: free, slot: TimeSlot{Start: tomorrowAt(from, 0), End: tomorrowAt(to, 0)}}
+	}
+	candidates := []groupCandidate{
+		slot(0b01, 10, 11), // covered
+		slot(0b011, 9, 12),
+		slot(0b01, 9, 12),  // covered, same window
+		slot(0b01, 8, 12),  // starts earlier
+		slot(0b100, 9, 10), // not a subset
+		slot(0b10, 11, 13), // ends later
+		slot(0b111, 14, 15),
+		slot(0b11, 14, 15), // covered
+	}
+	kept := dropCovered(candidates)
+	var got []string
+	for _, c := range kept {
+		got = append(got, c.slot.Start.Format("15")+"-"+c.slot.End.Format("15"))
+	}
+	want := "08-12 09-12 09-10 11-13 14-15"
+	if strings.Join(got, " ") != want {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+}
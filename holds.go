@@ -0,0 +1,731 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+const (
+	holdBucket = "holds"
+	// Private extended property that tags the events of a hold group
+	holdProperty = "calendargoHold"
+	// Put in front of the title of held events
+	holdPrefix = "Hold: "
+	// How long holds last when neither the request nor hold_minutes of
+	// the config say otherwise
+	defaultHoldLifetime = 12 * time.Hour
+	// How long the holds can still be deleted after they expire, when
+	// deleting them keeps failing
+	holdReleaseGrace = sessionLifetime
+	defaultHoldCount = 3
+	maxHoldCount     = 10
+)
+
+// Hold is a tentative event kept on one slot
+type Hold struct {
+	EventID string
+	SlotID  string
+	Start   time.Time
+	End     time.Time
+}
+
+// HoldGroup is a set of holds of which at most one gets confirmed,
+// the rest are deleted on confirmation or when the group expires
+type HoldGroup struct {
+	ID      string
+	CalId   string
+	Title   string
+	Holds   []Hold
+	Expires time.Time
+	// Account the holds belong to
+	owner string
+	// Session of the group's own, so that the holds can be deleted after
+	// the session of the user ended
+	session SessionToken
+}
+
+// storedHoldGroup is a group as it is kept in the store, its session id
+// is encrypted like the sessions themselves
+type storedHoldGroup struct {
+	HoldGroup
+	Owner         string
+	SealedSession []byte
+}
+
+// HoldRequest is the body of a POST to /holds. The slots to hold are either
+// given by id or are the best ones found with the query
+type HoldRequest struct {
+	Query
+	SlotIDs []string
+	// How many of the best slots to hold, 3 if zero
+	Count int
+	// Calendar the holds are created in, the primary calendar if empty
+	CalId       string
+	Title       string
+	Description string
+	Location    string
+	// Minutes until the holds are released, the server's default if zero
+	HoldMinutes int
+}
+
+func (h *HoldRequest) validate() error {
+	if h.Title == "" {
+		return fmt.Errorf("no title given")
+	}
+	if h.Count < 0 || h.Count > maxHoldCount {
+		return fmt.Errorf("at most %d slots can be held", maxHoldCount)
+	}
+	if h.HoldMinutes < 0 {
+		return fmt.Errorf("invalid hold minutes")
+	}
+	if len(h.SlotIDs) > maxHoldCount {
+		return fmt.Errorf("at most %d slots can be held", maxHoldCount)
+	}
+	if len(h.SlotIDs) == 0 {
+		return h.Query.validate()
+	}
+	if h.Duration < 0 {
+		return fmt.Errorf("invalid duration")
+	}
+	for _, id := range h.SlotIDs {
+		if _, _, err := parseSlotID(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HoldManager tracks the hold groups of all users. Each group has a copy
+// of the session that placed it, so its holds can be deleted after the
+// user logged out. When the sessions are kept in the store the groups are
+// too, and they outlive a restart
+type HoldManager struct {
+	mu       sync.Mutex
+	groups   map[string]*HoldGroup
+	store    *Store
+	sessions SessionStore
+	// Encrypts the session ids of the stored groups
+	sealer *DBSessionStore
+}
+
+// NewHoldManager loads the groups that were kept in the store
+func NewHoldManager(store *Store, sessions SessionStore) (*HoldManager, error) {
+	h := &HoldManager{groups: make(map[string]*HoldGroup), sessions: sessions}
+	sealer, durable := sessions.(*DBSessionStore)
+	if !durable {
+		return h, nil
+	}
+	h.store, h.sealer = store, sealer
+	err := store.ForEach(holdBucket, func(id string, data []byte) error {
+		var stored storedHoldGroup
+		if err := json.Unmarshal(data, &stored); err != nil {
+			logger.Println("Unable to read hold group", id, err)
+			return nil
+		}
+		session, err := sealer.unseal(holdBucket+"/"+id, stored.SealedSession)
+		if err != nil {
+			// Like a session written with an older server key
+			logger.Println("Unable to decrypt the session of hold group", id, err)
+			return nil
+		}
+		group := stored.HoldGroup
+		group.owner, group.session = stored.Owner, SessionToken(session)
+		h.groups[id] = &group
+		return nil
+	})
+	return h, err
+}
+
+// Durable reports whether the groups outlive a restart
+func (h *HoldManager) Durable() bool {
+	return h.store != nil
+}
+
+// save keeps the group in the store, where it is found again after a restart
+func (h *HoldManager) save(group *HoldGroup) {
+	if h.store == nil {
+		return
+	}
+	session, err := h.sealer.seal(holdBucket+"/"+group.ID, []byte(group.session))
+	if err == nil {
+		err = h.store.PutJSON(holdBucket, group.ID, storedHoldGroup{HoldGroup: *group, Owner: group.owner, SealedSession: session})
+	}
+	if err != nil {
+		logger.Println("Unable to save hold group", group.ID, err)
+	}
+}
+
+// forget drops a group whose holds are all gone, along with its session
+func (h *HoldManager) forget(group *HoldGroup) {
+	if err := h.sessions.Delete(group.session); err != nil {
+		logger.Println("Unable to delete the session of hold group", group.ID, err)
+	}
+	if h.store == nil {
+		return
+	}
+	if err := h.store.Delete(holdBucket, group.ID); err != nil {
+		logger.Println("Unable to delete hold group", group.ID, err)
+	}
+}
+
+func (h *HoldManager) add(group *HoldGroup) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.groups[group.ID] = group
+	h.save(group)
+}
+
+// take removes the group so that only one request works on it at a time,
+// it stays in the store until it is forgotten
+func (h *HoldManager) take(owner string, id string) (*HoldGroup, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	group, ok := h.groups[id]
+	if !ok || group.owner != owner {
+		return nil, false
+	}
+	delete(h.groups, id)
+	return group, true
+}
+
+// List returns the groups of the user, soonest to expire first
+func (h *HoldManager) List(owner string) []HoldGroup {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	groups := []HoldGroup{}
+	for _, g := range h.groups {
+		if g.owner == owner {
+			groups = append(groups, *g)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Expires.Before(groups[j].Expires)
+	})
+	return groups
+}
+
+// Place creates a tentative event for each window that is still free and
+// starts tracking them as one group, under a copy of the user's session
+func (h *HoldManager) Place(ctx context.Context, source EventSource, owner string, userSession SessionToken, req HoldRequest, windows []Hold, loc *time.Location, lifetime time.Duration, buffers BufferConfig) (*HoldGroup, error) {
+	writer, ok := source.(EventWriter)
+	if !ok {
+		return nil, fmt.Errorf("the calendar source cannot create events")
+	}
+	calID := req.CalId
+	if calID == "" {
+		calID = "primary"
+	}
+	checkIDs := req.CalIds
+	if len(checkIDs) == 0 {
+		checkIDs = []string{calID}
+	}
+	group := &HoldGroup{
+		ID:      randState(),
+		CalId:   calID,
+		Title:   req.Title,
+		Expires: time.Now().Add(lifetime),
+		owner:   owner,
+	}
+	if group.ID == "" {
+		return nil, fmt.Errorf("unable to create a hold id")
+	}
+	session, found, err := h.sessions.Get(userSession)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("the session ended")
+	}
+	group.session, err = newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	held := *session
+	held.Expires = group.Expires.Add(holdReleaseGrace)
+	if err := h.sessions.Put(group.session, &held); err != nil {
+		return nil, err
+	}
+	// Kept before any event exists, so that events created right before a
+	// crash are found by their tag
+	h.save(group)
+	failed := func() {
+		if h.release(ctx, writer, group) {
+			h.forget(group)
+		} else {
+			h.add(group)
+		}
+	}
+
+	for _, w := range windows {
+		busy := BusyOptions{TentativeFree: req.TentativeFree, IgnoreAllDay: req.IgnoreAllDay}
+		err := checkFree(ctx, source, checkIDs, w.Start.In(loc), w.End.In(loc), busy, buffers)
+		var taken *SlotTakenError
+		if errors.As(err, &taken) {
+			logger.Println("Not holding", w.SlotID, err)
+			continue
+		}
+		if err != nil {
+			failed()
+			return nil, err
+		}
+		created, err := writer.InsertEvent(ctx, calID, &calendar.Event{
+			Summary:     holdPrefix + req.Title,
+			Description: req.Description,
+			Location:    req.Location,
+			Status:      "tentative",
+			Start:       eventDateTime(w.Start, loc),
+			End:         eventDateTime(w.End, loc),
+			ExtendedProperties: &calendar.EventExtendedProperties{
+				Private: map[string]string{holdProperty: group.ID},
+			},
+		})
+		if err != nil {
+			failed()
+			return nil, err
+		}
+		w.EventID = created.Id
+		group.Holds = append(group.Holds, w)
+	}
+	if len(group.Holds) == 0 {
+		h.forget(group)
+		return nil, &SlotTakenError{}
+	}
+	h.add(group)
+	return group, nil
+}
+
+// Confirm turns the chosen hold into a confirmed event and deletes the others
+func (h *HoldManager) Confirm(ctx context.Context, source EventSource, owner string, groupID, eventID string, attendees []string) (*calendar.Event, error) {
+	writer, ok := source.(EventWriter)
+	if !ok {
+		return nil, fmt.Errorf("the calendar source cannot change events")
+	}
+	group, ok := h.take(owner, groupID)
+	if !ok {
+		return nil, errHoldNotFound
+	}
+	chosen := -1
+	for i, hold := range group.Holds {
+		if hold.EventID == eventID {
+			chosen = i
+		}
+	}
+	if chosen < 0 {
+		h.add(group)
+		return nil, errHoldNotFound
+	}
+
+	// The confirmed event loses its tag, so releasing the group leaves it be
+	patch := &calendar.Event{
+		Summary: group.Title,
+		Status:  "confirmed",
+		ExtendedProperties: &calendar.EventExtendedProperties{
+			Private: map[string]string{holdProperty: ""},
+		},
+	}
+	for _, a := range attendees {
+		patch.Attendees = append(patch.Attendees, &calendar.EventAttendee{Email: a})
+	}
+	confirmed, err := writer.PatchEvent(ctx, group.CalId, eventID, patch)
+	if err != nil {
+		// The group is kept so the confirmation can be retried
+		h.add(group)
+		return nil, err
+	}
+	group.Holds = append(group.Holds[:chosen:chosen], group.Holds[chosen+1:]...)
+	if !h.release(ctx, writer, group) {
+		// The holds left over are released when the group expires
+		h.add(group)
+		return confirmed, nil
+	}
+	h.forget(group)
+	return confirmed, nil
+}
+
+// Release deletes all the holds of the group
+func (h *HoldManager) Release(ctx context.Context, source EventSource, owner string, groupID string) error {
+	writer, ok := source.(EventWriter)
+	if !ok {
+		return fmt.Errorf("the calendar source cannot change events")
+	}
+	group, ok := h.take(owner, groupID)
+	if !ok {
+		return errHoldNotFound
+	}
+	if !h.release(ctx, writer, group) {
+		h.add(group)
+		return fmt.Errorf("unable to delete all holds")
+	}
+	h.forget(group)
+	return nil
+}
+
+// release deletes the events of the group, along with the events tagged
+// with the group that it has no record of, keeping the holds that could
+// not be deleted in the group. It reports whether all were deleted
+func (h *HoldManager) release(ctx context.Context, writer EventWriter, group *HoldGroup) bool {
+	untracked, err := h.untracked(ctx, writer, group)
+	if err != nil {
+		logger.Println("Unable to look for the holds of group", group.ID, err)
+		return false
+	}
+	var left []Hold
+	for _, hold := range append(group.Holds, untracked...) {
+		if err := writer.DeleteEvent(ctx, group.CalId, hold.EventID); err != nil {
+			logger.Println("Unable to delete hold", hold.EventID, err)
+			left = append(left, hold)
+		}
+	}
+	group.Holds = left
+	return len(left) == 0
+}
+
+// untracked lists the events tagged with the group that it does not hold,
+// like the ones created right before the server stopped
+func (h *HoldManager) untracked(ctx context.Context, writer EventWriter, group *HoldGroup) ([]Hold, error) {
+	tagged, ok := writer.(TaggedSource)
+	if !ok {
+		return nil, nil
+	}
+	events, err := tagged.ListTagged(ctx, group.CalId, holdProperty, group.ID)
+	if err != nil {
+		return nil, err
+	}
+	var untracked []Hold
+	for _, e := range events {
+		if !slices.ContainsFunc(group.Holds, func(hold Hold) bool { return hold.EventID == e.Id }) {
+			untracked = append(untracked, Hold{EventID: e.Id})
+		}
+	}
+	return untracked, nil
+}
+
+// Recover deletes the events of every group that were created but not
+// recorded before the server stopped, and drops the groups whose session
+// is gone so nothing can be deleted anymore
+func (h *HoldManager) Recover(ctx context.Context, sourceFor func(SessionToken) (EventSource, bool)) {
+	h.mu.Lock()
+	groups := make([]*HoldGroup, 0, len(h.groups))
+	for _, g := range h.groups {
+		groups = append(groups, g)
+	}
+	h.mu.Unlock()
+
+	for _, g := range groups {
+		source, ok := sourceFor(g.session)
+		if !ok {
+			logger.Println("Dropping hold group", g.ID, "whose session is gone, its holds stay in the calendar")
+			if g, ok := h.take(g.owner, g.ID); ok {
+				h.forget(g)
+			}
+			continue
+		}
+		writer, ok := source.(EventWriter)
+		if !ok {
+			continue
+		}
+		untracked, err := h.untracked(ctx, writer, g)
+		if err != nil {
+			logger.Println("Unable to look for the holds of group", g.ID, err)
+			continue
+		}
+		for _, hold := range untracked {
+			if err := writer.DeleteEvent(ctx, g.CalId, hold.EventID); err != nil {
+				logger.Println("Unable to delete hold", hold.EventID, err)
+			}
+		}
+	}
+}
+
+// ReleaseExpired releases the groups that expired before now, groups whose
+// holds cannot be deleted yet are retried on the next call
+func (h *HoldManager) ReleaseExpired(ctx context.Context, now time.Time, sourceFor func(SessionToken) (EventSource, bool)) int {
+	return h.releaseWhere(ctx, sourceFor, func(g *HoldGroup) bool {
+		return !now.Before(g.Expires)
+	})
+}
+
+// ReleaseAll releases every group, used when the server stops
+func (h *HoldManager) ReleaseAll(ctx context.Context, sourceFor func(SessionToken) (EventSource, bool)) int {
+	return h.releaseWhere(ctx, sourceFor, func(g *HoldGroup) bool { return true })
+}
+
+func (h *HoldManager) releaseWhere(ctx context.Context, sourceFor func(SessionToken) (EventSource, bool), match func(*HoldGroup) bool) int {
+	h.mu.Lock()
+	var matched []*HoldGroup
+	for id, g := range h.groups {
+		if match(g) {
+			matched = append(matched, g)
+			delete(h.groups, id)
+		}
+	}
+	h.mu.Unlock()
+
+	released := 0
+	for _, g := range matched {
+		source, ok := sourceFor(g.session)
+		if !ok {
+			// The session of the group expired after the grace period
+			logger.Println("Dropping hold group", g.ID, "whose session is gone, its holds stay in the calendar")
+			h.forget(g)
+			continue
+		}
+		writer, ok := source.(EventWriter)
+		if !ok {
+			h.forget(g)
+			continue
+		}
+		if !h.release(ctx, writer, g) {
+			h.add(g)
+			continue
+		}
+		h.forget(g)
+		released++
+	}
+	return released
+}
+
+var errHoldNotFound = errors.New("hold not found")
+
+// holdWindows finds the windows to hold, either from the given slot ids or
+// from the best slots of the query
+func (ss ServerState) holdWindows(source EventSource, req HoldRequest) ([]Hold, error) {
+	var windows []Hold
+	if len(req.SlotIDs) > 0 {
+		for _, id := range req.SlotIDs {
+			start, end, _ := parseSlotID(id)
+			if req.Duration > 0 {
+				if start.Add(req.Duration).After(end) {
+					return nil, fmt.Errorf("the event does not fit in slot %v", id)
+				}
+				end = start.Add(req.Duration)
+			}
+			windows = append(windows, Hold{SlotID: id, Start: start, End: end})
+		}
+		return windows, nil
+	}
+
+	opts, err := ss.slotOpts(source, req.Query)
+	if err != nil {
+		return nil, err
+	}
+	results, err := findSlots(opts)
+	if err != nil {
+		return nil, err
+	}
+	count := req.Count
+	if count == 0 {
+		count = defaultHoldCount
+	}
+	for _, slot := range results.Slots {
+		if len(windows) == count {
+			break
+		}
+		hold := Hold{SlotID: slot.ID, Start: slot.Start, End: slot.Start.Add(req.Duration)}
+		// Candidates split from one window overlap each other
+		if slices.ContainsFunc(windows, func(w Hold) bool {
+			return w.Start.Before(hold.End) && hold.Start.Before(w.End)
+		}) {
+			continue
+		}
+		windows = append(windows, hold)
+	}
+	return windows, nil
+}
+
+// holds lists the hold groups of the user on GET and places new holds on POST
+func holds(ss ServerState) func(rw http.ResponseWriter, req *http.Request) {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		token, source, ok := ss.userSource(rw, req)
+		if !ok {
+			return
+		}
+		switch req.Method {
+		case http.MethodGet:
+			rw.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(rw).Encode(ss.holds.List(ss.owner(token)))
+			return
+		case http.MethodPost:
+		default:
+			http.Error(rw, "Only GET and POST are allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		defer req.Body.Close()
+
+		holdReq := HoldRequest{}
+		err := json.NewDecoder(req.Body).Decode(&holdReq)
+		if err != nil {
+			http.Error(rw, "Please provide the holds in the body of the request in the following format: {\"SlotIDs\": [\"1700000000-1700003600\"], \"Duration\": 60, \"Title\": \"Site visit\"} or a slot query with a \"Count\"\n", http.StatusBadRequest)
+			logger.Println("Unable to decode hold request")
+			return
+		}
+		// The duration is in minutes
+		holdReq.Duration *= time.Minute
+
+		err = holdReq.validate()
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			logger.Println("Invalid hold request", err)
+			return
+		}
+		loc, err := loadLocation(firstNonEmpty(holdReq.TimeZone, ss.defaults.TimeZone))
+		if err != nil {
+			http.Error(rw, "Invalid time zone: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		lifetime := defaultHoldLifetime
+		if holdReq.HoldMinutes > 0 {
+			lifetime = time.Duration(holdReq.HoldMinutes) * time.Minute
+		} else if ss.defaults.HoldMinutes > 0 {
+			lifetime = time.Duration(ss.defaults.HoldMinutes) * time.Minute
+		}
+
+		windows, err := ss.holdWindows(source, holdReq)
+		if err != nil {
+			http.Error(rw, "Unable to find slots to hold: "+err.Error(), http.StatusBadRequest)
+			logger.Println("Unable to find slots to hold", err)
+			return
+		}
+		if len(windows) == 0 {
+			http.Error(rw, "No free slots to hold", http.StatusNotFound)
+			return
+		}
+
+		group, err := ss.holds.Place(req.Context(), source, ss.owner(token), token, holdReq, windows, loc, lifetime, ss.defaults.Buffers.with(holdReq.buffers()))
+		if err != nil {
+			var taken *SlotTakenError
+			if errors.As(err, &taken) {
+				http.Error(rw, "None of the slots are free anymore", http.StatusConflict)
+				return
+			}
+			http.Error(rw, "Unable to hold the slots: "+err.Error(), http.StatusInternalServerError)
+			logger.Println("Unable to hold the slots", err)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusCreated)
+		json.NewEncoder(rw).Encode(group)
+	}
+}
+
+// HoldChoice is the body of /holds/confirm and /holds/release
+type HoldChoice struct {
+	GroupID string
+	// The hold to confirm, unused when releasing
+	EventID string
+	// Emails of the people to invite to the confirmed event
+	Attendees []string
+}
+
+func confirmHold(ss ServerState) func(rw http.ResponseWriter, req *http.Request) {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(rw, "Only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token, source, ok := ss.userSource(rw, req)
+		if !ok {
+			return
+		}
+		defer req.Body.Close()
+
+		choice := HoldChoice{}
+		if err := json.NewDecoder(req.Body).Decode(&choice); err != nil || choice.GroupID == "" || choice.EventID == "" {
+			http.Error(rw, "Please provide the hold in the body of the request in the following format: {\"GroupID\": \"...\", \"EventID\": \"...\"}\n", http.StatusBadRequest)
+			return
+		}
+		for _, a := range choice.Attendees {
+			if !strings.Contains(a, "@") {
+				http.Error(rw, fmt.Sprintf("invalid attendee email %q", a), http.StatusBadRequest)
+				return
+			}
+		}
+
+		confirmed, err := ss.holds.Confirm(req.Context(), source, ss.owner(token), choice.GroupID, choice.EventID, choice.Attendees)
+		if errors.Is(err, errHoldNotFound) {
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(rw, "Unable to confirm the hold: "+err.Error(), http.StatusInternalServerError)
+			logger.Println("Unable to confirm the hold", err)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(confirmed)
+	}
+}
+
+func releaseHold(ss ServerState) func(rw http.ResponseWriter, req *http.Request) {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(rw, "Only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token, source, ok := ss.userSource(rw, req)
+		if !ok {
+			return
+		}
+		defer req.Body.Close()
+
+		choice := HoldChoice{}
+		if err := json.NewDecoder(req.Body).Decode(&choice); err != nil || choice.GroupID == "" {
+			http.Error(rw, "Please provide the hold in the body of the request in the following format: {\"GroupID\": \"...\"}\n", http.StatusBadRequest)
+			return
+		}
+		err := ss.holds.Release(req.Context(), source, ss.owner(token), choice.GroupID)
+		if errors.Is(err, errHoldNotFound) {
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(rw, "Unable to release the holds: "+err.Error(), http.StatusInternalServerError)
+			logger.Println("Unable to release the holds", err)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// startHoldReleaser releases the holds that expired while the server was
+// stopped and cleans up after the groups it was placing, then releases
+// expired holds every interval until the returned stop function is
+// called, stop waits for the releaser
+func startHoldReleaser(ss ServerState, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		if released := ss.holds.ReleaseExpired(ss.ctx, time.Now(), ss.sourceFor); released > 0 {
+			logger.Println("Released", released, "hold groups that expired while stopped")
+		}
+		ss.holds.Recover(ss.ctx, ss.sourceFor)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				if released := ss.holds.ReleaseExpired(ss.ctx, now, ss.sourceFor); released > 0 {
+					logger.Println("Released", released, "expired hold groups")
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-finished
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+func TestHoldsOutliveTheSession(t *testing.T) {
+	store, err := OpenStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	sessions, err := NewDBSessionStore(store, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := SessionToken("user")
+	if err := sessions.Put(user, &Session{User: "alice@example.com", Expires: time.Now().Add(sessionLifetime)}); err != nil {
+		t.Fatal(err)
+	}
+	src := NewMemorySource()
+	src.Add("primary", "Primary")
+	sourceFor := func(token SessionToken) (EventSource, bool) {
+		_, found, _ := sessions.Get(token)
+		return src, found
+	}
+
+	ctx := context.Background()
+	holds, err := NewHoldManager(store, sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2030, 1, 7, 9, 0, 0, 0, time.UTC)
+	windows := []Hold{
+		{Start: start, End: start.Add(time.Hour)},
+		{Start: start.Add(2 * time.Hour), End: start.Add(3 * time.Hour)},
+	}
+	group, err := holds.Place(ctx, src, "alice@example.com", user, HoldRequest{Title: "Visit"}, windows, time.UTC, time.Hour, BufferConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _, err := store.Get(holdBucket, group.ID)
+	if err != nil || bytes.Contains(raw, []byte(group.session)) {
+		t.Errorf("the session id of the group is stored in plain text, %v", err)
+	}
+	// Created right before a crash, without being recorded in the group
+	src.InsertEvent(ctx, "primary", &calendar.Event{
+		Start:              eventDateTime(start.Add(4*time.Hour), time.UTC),
+		End:                eventDateTime(start.Add(5*time.Hour), time.UTC),
+		ExtendedProperties: &calendar.EventExtendedProperties{Private: map[string]string{holdProperty: group.ID}},
+	})
+
+	// The user logs out and the server restarts
+	if err := sessions.Delete(user); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := NewHoldManager(store, sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted.List("alice@example.com"); len(got) != 1 || len(got[0].Holds) != 2 {
+		t.Fatalf("restarted with %+v", got)
+	}
+	restarted.Recover(ctx, sourceFor)
+	if n := len(src.Events["primary"]); n != 2 {
+		t.Errorf("%d events after recovering, the untracked hold should be gone", n)
+	}
+	if released := restarted.ReleaseExpired(ctx, group.Expires, sourceFor); released != 1 {
+		t.Fatalf("released %d groups", released)
+	}
+	if n := len(src.Events["primary"]); n != 0 {
+		t.Errorf("%d holds left after expiry", n)
+	}
+	if _, found, _ := sessions.Get(group.session); found {
+		t.Error("the session of the released group was kept")
+	}
+	again, err := NewHoldManager(store, sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := again.List("alice@example.com"); len(got) != 0 {
+		t.Errorf("released group still stored: %+v", got)
+	}
+}
+
+func TestHoldsStayBusyWhenTentativeIsFree(t *testing.T) {
+	start := time.Date(2030, 1, 7, 9, 0, 0, 0, time.UTC)
+	hold := testEvent(holdPrefix+"Visit", "", start, start.Add(time.Hour))
+	hold.Status = "tentative"
+	hold.ExtendedProperties = &calendar.EventExtendedProperties{Private: map[string]string{holdProperty: "group"}}
+	src := NewMemorySource()
+	src.Add("primary", "Primary", hold)
+
+	busy := BusyOptions{TentativeFree: true}
+	err := checkFree(context.Background(), src, []string{"primary"}, start, start.Add(time.Hour), busy, BufferConfig{})
+	var taken *SlotTakenError
+	if !errors.As(err, &taken) {
+		t.Errorf("a held slot was free: %v", err)
+	}
+}
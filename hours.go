@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ClockTime is a time of day in minutes since midnight
+type ClockTime int
+
+func parseClockTime(s string) (ClockTime, error) {
+	var h, m int
+	_, err := fmt.Sscanf(strings.TrimSpace(s), "%d:%d", &h, &m)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	if h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return ClockTime(h*60 + m), nil
+}
+
+func (c ClockTime) String() string {
+	return fmt.Sprintf("%02d:%02d", c/60, c%60)
+}
+
+// On returns the clock time on the given date in loc, times that a DST
+// transition skips or repeats are resolved by time.Date
+func (c ClockTime) On(d Date, loc *time.Location) time.Time {
+	return time.Date(d.Year, d.Month, d.Day, int(c)/60, int(c)%60, 0, 0, loc)
+}
+
+// TimeRange is a range of the day, written as "08:00-12:00" in json
+type TimeRange struct {
+	Start ClockTime
+	End   ClockTime
+}
+
+func parseTimeRange(s string) (TimeRange, error) {
+	start, end, found := strings.Cut(s, "-")
+	if !found {
+		return TimeRange{}, fmt.Errorf("invalid time range %q, expected HH:MM-HH:MM", s)
+	}
+	var r TimeRange
+	var err error
+	if r.Start, err = parseClockTime(start); err != nil {
+		return TimeRange{}, err
+	}
+	if r.End, err = parseClockTime(end); err != nil {
+		return TimeRange{}, err
+	}
+	if r.End <= r.Start {
+		return TimeRange{}, fmt.Errorf("time range %q ends before it starts", s)
+	}
+	return r, nil
+}
+
+func (r TimeRange) String() string {
+	return r.Start.String() + "-" + r.End.String()
+}
+
+func (r TimeRange) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+func (r *TimeRange) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := parseTimeRange(s)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+// WorkingHours holds the ranges of each weekday that can be scheduled,
+// written in json as {"monday": ["08:00-12:00", "13:00-18:30"], ...}
+type WorkingHours map[time.Weekday][]TimeRange
+
+func DefaultWorkingHours() WorkingHours {
+	hours := make(WorkingHours)
+	for wd := time.Monday; wd <= time.Friday; wd++ {
+		hours[wd] = []TimeRange{{Start: 9 * 60, End: 17 * 60}}
+	}
+	return hours
+}
+
+func parseWeekday(s string) (time.Weekday, error) {
+	for wd := time.Sunday; wd <= time.Saturday; wd++ {
+		if strings.EqualFold(s, wd.String()) || strings.EqualFold(s, wd.String()[:3]) {
+			return wd, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid weekday %q", s)
+}
+
+// For returns the sorted ranges for the weekday
+func (w WorkingHours) For(wd time.Weekday) []TimeRange {
+	return w[wd]
+}
+
+func (w WorkingHours) MarshalJSON() ([]byte, error) {
+	m := make(map[string][]TimeRange, len(w))
+	for wd, ranges := range w {
+		m[strings.ToLower(wd.String())] = ranges
+	}
+	return json.Marshal(m)
+}
+
+func (w *WorkingHours) UnmarshalJSON(b []byte) error {
+	var m map[string][]TimeRange
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	hours := make(WorkingHours, len(m))
+	for name, ranges := range m {
+		wd, err := parseWeekday(name)
+		if err != nil {
+			return err
+		}
+		hours[wd] = append(hours[wd], ranges...)
+	}
+	for _, ranges := range hours {
+		sort.Slice(ranges, func(i, j int) bool {
+			return ranges[i].Start < ranges[j].Start
+		})
+	}
+	*w = hours
+	return hours.validate()
+}
+
+func (w WorkingHours) validate() error {
+	for wd, ranges := range w {
+		for i, r := range ranges {
+			if r.End <= r.Start {
+				return fmt.Errorf("%v: time range %v ends before it starts", wd, r)
+			}
+			if i > 0 && r.Start < ranges[i-1].End {
+				return fmt.Errorf("%v: time ranges %v and %v overlap", wd, ranges[i-1], r)
+			}
+		}
+	}
+	return nil
+}
+
+// loadLocation loads the IANA zone, the local zone is used for an empty name
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(name)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTimeRange(t *testing.T) {
+	tests := []struct {
+		in    string
+		want  TimeRange
+		fails bool
+	}{
+		{"08:00-12:00", TimeRange{8 * 60, 12 * 60}, false},
+		{" 9:30 - 18:45 ", TimeRange{9*60 + 30, 18*60 + 45}, false},
+		{"00:00-24:00", TimeRange{0, 24 * 60}, false},
+		{"12:00-08:00", TimeRange{}, true},
+		{"08:00-08:00", TimeRange{}, true},
+		{"08:00", TimeRange{}, true},
+		{"8-12", TimeRange{}, true},
+		{"08:60-12:00", TimeRange{}, true},
+		{"08:00-24:30", TimeRange{}, true},
+		{"-1:00-12:00", TimeRange{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseTimeRange(tt.in)
+		if (err != nil) != tt.fails || got != tt.want {
+			t.Errorf("parseTimeRange(%q) = %v, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestWorkingHoursJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    string
+		want  WorkingHours
+		fails bool
+	}{
+		{"full names", `{"monday": ["08:00-12:00", "13:00-18:30"]}`,
+			WorkingHours{time.Monday: {{8 * 60, 12 * 60}, {13 * 60, 18*60 + 30}}}, false},
+		{"short names in any case", `{"TUE": ["09:00-17:00"], "Sat": ["10:00-12:00"]}`,
+			WorkingHours{time.Tuesday: {{9 * 60, 17 * 60}}, time.Saturday: {{10 * 60, 12 * 60}}}, false},
+		{"sorted ranges", `{"friday": ["13:00-17:00", "08:00-12:00"]}`,
+			WorkingHours{time.Friday: {{8 * 60, 12 * 60}, {13 * 60, 17 * 60}}}, false},
+		{"same day twice", `{"wednesday": ["13:00-17:00"], "wed": ["08:00-12:00"]}`,
+			WorkingHours{time.Wednesday: {{8 * 60, 12 * 60}, {13 * 60, 17 * 60}}}, false},
+		{"day off", `{"sunday": []}`, WorkingHours{time.Sunday: nil}, false},
+		{"overlapping ranges", `{"monday": ["08:00-12:00", "11:00-14:00"]}`, nil, true},
+		{"unknown day", `{"someday": ["08:00-12:00"]}`, nil, true},
+		{"invalid range", `{"monday": ["8am-noon"]}`, nil, true},
+		{"not a list", `{"monday": "08:00-12:00"}`, nil, true},
+	}
+	for _, tt := range tests {
+		var got WorkingHours
+		err := json.Unmarshal([]byte(tt.in), &got)
+		if (err != nil) != tt.fails {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if !tt.fails && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWorkingHoursRoundTrip(t *testing.T) {
+	hours := DefaultWorkingHours()
+	hours[time.Saturday] = []TimeRange{{8 * 60, 12 * 60}, {13 * 60, 15 * 60}}
+	b, err := json.Marshal(hours)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got WorkingHours
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("%s: %v", b, err)
+	}
+	if !reflect.DeepEqual(got, hours) {
+		t.Errorf("%s read back as %v", b, got)
+	}
+}
@@ -0,0 +1,765 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+// ICSCalendar is a parsed iCalendar file
+type ICSCalendar struct {
+	// X-WR-CALNAME of the file, if any
+	Name   string
+	events []*icsEvent
+}
+
+// icsEvent is a VEVENT, recurring ones are expanded when listed
+type icsEvent struct {
+	uid, summary, location, description string
+	// Lower case like the calendar API, such as "tentative"
+	status       string
+	transparency string
+	// Timed events start in their zone, all day ones at midnight UTC
+	start  time.Time
+	allDay bool
+	// Length of timed events, all day events last whole days
+	length time.Duration
+	days   int
+	rule   *recurrence
+	// Excluded instances, by start time and by date for EXDATE;VALUE=DATE
+	exTimes map[int64]bool
+	exDates map[string]bool
+	// Set on events that replace one instance of a recurring event
+	recurrenceID time.Time
+}
+
+type icsProperty struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// ParseICS reads the VEVENTs of an iCalendar file. Times without a zone are
+// read in the file's X-WR-TIMEZONE, or in loc if it has none
+func ParseICS(r io.Reader, loc *time.Location) (*ICSCalendar, error) {
+	props, err := readICSProperties(r)
+	if err != nil {
+		return nil, err
+	}
+	cal := &ICSCalendar{}
+	var current []icsProperty
+	depth := 0
+	// Depth of the VEVENT being read, zero outside of one. Components nested
+	// in it, like VALARM, have properties of their own that are skipped
+	eventDepth := 0
+	inEvent := false
+	for _, p := range props {
+		switch {
+		case p.name == "BEGIN":
+			depth++
+			if !inEvent && strings.EqualFold(p.value, "VEVENT") {
+				inEvent = true
+				eventDepth = depth
+				current = nil
+			}
+			continue
+		case p.name == "END":
+			if inEvent && depth == eventDepth && strings.EqualFold(p.value, "VEVENT") {
+				inEvent = false
+				e, err := parseICSEvent(current, loc)
+				if err != nil {
+					return nil, err
+				}
+				cal.events = append(cal.events, e)
+			}
+			depth--
+			continue
+		}
+		if inEvent {
+			if depth == eventDepth {
+				current = append(current, p)
+			}
+			continue
+		}
+		// Calendar properties come before the components that use them
+		if depth == 1 {
+			switch p.name {
+			case "X-WR-CALNAME":
+				cal.Name = unescapeICSText(p.value)
+			case "X-WR-TIMEZONE":
+				if l, ok := icsLocation(p.value); ok {
+					loc = l
+				}
+			}
+		}
+	}
+	if inEvent || depth != 0 {
+		return nil, fmt.Errorf("unterminated component in calendar")
+	}
+	cal.applyOverrides()
+	return cal, nil
+}
+
+// readICSProperties unfolds the content lines and splits them into properties
+func readICSProperties(r io.Reader) ([]icsProperty, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var lines []string
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			// Folded lines continue the previous one
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	props := make([]icsProperty, 0, len(lines))
+	for n, line := range lines {
+		p, err := parseICSLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n+1, err)
+		}
+		props = append(props, p)
+	}
+	return props, nil
+}
+
+func parseICSLine(line string) (icsProperty, error) {
+	// The value starts at the first colon outside of a quoted parameter
+	quoted := false
+	colon := -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return icsProperty{}, fmt.Errorf("no value in %q", line)
+	}
+	head, value := line[:colon], line[colon+1:]
+	parts := strings.Split(head, ";")
+	p := icsProperty{name: strings.ToUpper(parts[0]), params: make(map[string]string), value: value}
+	for _, param := range parts[1:] {
+		k, v, _ := strings.Cut(param, "=")
+		p.params[strings.ToUpper(k)] = strings.Trim(v, "\"")
+	}
+	return p, nil
+}
+
+func unescapeICSText(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			switch s[i] {
+			case 'n', 'N':
+				b.WriteByte('\n')
+			default:
+				b.WriteByte(s[i])
+			}
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func parseICSEvent(props []icsProperty, loc *time.Location) (*icsEvent, error) {
+	e := &icsEvent{exTimes: make(map[int64]bool), exDates: make(map[string]bool)}
+	var end time.Time
+	var duration *time.Duration
+	var ruleValue string
+	for _, p := range props {
+		var err error
+		switch p.name {
+		case "UID":
+			e.uid = p.value
+		case "SUMMARY":
+			e.summary = unescapeICSText(p.value)
+		case "LOCATION":
+			e.location = unescapeICSText(p.value)
+		case "DESCRIPTION":
+			e.description = unescapeICSText(p.value)
+		case "STATUS":
+			e.status = strings.ToLower(p.value)
+		case "TRANSP":
+			if strings.EqualFold(p.value, "TRANSPARENT") {
+				e.transparency = "transparent"
+			}
+		case "DTSTART":
+			e.start, e.allDay, err = parseICSTime(p, loc)
+		case "DTEND":
+			end, _, err = parseICSTime(p, loc)
+		case "DURATION":
+			var d time.Duration
+			d, err = parseICSDuration(p.value)
+			duration = &d
+		case "RRULE":
+			ruleValue = p.value
+		case "EXDATE":
+			for _, v := range strings.Split(p.value, ",") {
+				var t time.Time
+				var allDay bool
+				t, allDay, err = parseICSTime(icsProperty{p.name, p.params, v}, loc)
+				if err != nil {
+					break
+				}
+				if allDay {
+					e.exDates[t.Format(time.DateOnly)] = true
+				} else {
+					e.exTimes[t.Unix()] = true
+				}
+			}
+		case "RECURRENCE-ID":
+			e.recurrenceID, _, err = parseICSTime(p, loc)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("event %q: %v: %w", e.uid, p.name, err)
+		}
+	}
+	if e.start.IsZero() {
+		return nil, fmt.Errorf("event %q has no DTSTART", e.uid)
+	}
+
+	switch {
+	case e.allDay:
+		e.days = 1
+		if !end.IsZero() {
+			e.days = int(end.Sub(e.start).Round(24*time.Hour) / (24 * time.Hour))
+		} else if duration != nil {
+			e.days = int(duration.Round(24*time.Hour) / (24 * time.Hour))
+		}
+		if e.days < 1 {
+			e.days = 1
+		}
+	case !end.IsZero():
+		e.length = end.Sub(e.start)
+	case duration != nil:
+		e.length = *duration
+	}
+	if e.length < 0 {
+		return nil, fmt.Errorf("event %q ends before it starts", e.uid)
+	}
+
+	if ruleValue != "" {
+		rule, err := parseRecurrence(ruleValue, loc)
+		if err != nil {
+			// The first instance is still known
+			logger.Printf("Ignoring the recurrence of event %q: %v\n", e.uid, err)
+		} else {
+			e.rule = rule
+		}
+	}
+	return e, nil
+}
+
+// parseICSTime reads a DATE or DATE-TIME value, all day dates are
+// returned at midnight UTC
+func parseICSTime(p icsProperty, loc *time.Location) (t time.Time, allDay bool, err error) {
+	value := strings.TrimSpace(p.value)
+	if strings.EqualFold(p.params["VALUE"], "DATE") || len(value) == 8 {
+		t, err = time.Parse("20060102", value)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err = time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+	if tzid := p.params["TZID"]; tzid != "" {
+		if l, ok := icsLocation(tzid); ok {
+			loc = l
+		} else {
+			logger.Printf("Unknown time zone %q, using %v\n", tzid, loc)
+		}
+	}
+	t, err = time.ParseInLocation("20060102T150405", value, loc)
+	return t, false, err
+}
+
+// Windows zone names some calendar exports use in TZID
+var windowsZones = map[string]string{
+	"Eastern Standard Time":          "America/New_York",
+	"Central Standard Time":          "America/Chicago",
+	"Mountain Standard Time":         "America/Denver",
+	"Pacific Standard Time":          "America/Los_Angeles",
+	"GMT Standard Time":              "Europe/London",
+	"W. Europe Standard Time":        "Europe/Berlin",
+	"Romance Standard Time":          "Europe/Paris",
+	"Central Europe Standard Time":   "Europe/Budapest",
+	"AUS Eastern Standard Time":      "Australia/Sydney",
+	"India Standard Time":            "Asia/Kolkata",
+	"Tokyo Standard Time":            "Asia/Tokyo",
+	"China Standard Time":            "Asia/Shanghai",
+	"E. South America Standard Time": "America/Sao_Paulo",
+	"UTC":                            "UTC",
+}
+
+// icsLocation finds the zone of a TZID, which is usually an IANA name
+// but can have a vendor prefix or be a Windows name
+func icsLocation(tzid string) (*time.Location, bool) {
+	tzid = strings.Trim(tzid, "\" ")
+	if name, ok := windowsZones[tzid]; ok {
+		tzid = name
+	}
+	if l, err := time.LoadLocation(tzid); err == nil && tzid != "" {
+		return l, true
+	}
+	// Such as /mozilla.org/20050126_1/America/New_York
+	parts := strings.Split(strings.Trim(tzid, "/"), "/")
+	for i := 1; i < len(parts); i++ {
+		if l, err := time.LoadLocation(strings.Join(parts[i:], "/")); err == nil {
+			return l, true
+		}
+	}
+	return nil, false
+}
+
+// parseICSDuration reads values such as P1D, PT1H30M and P2W
+func parseICSDuration(value string) (time.Duration, error) {
+	s := strings.TrimPrefix(value, "+")
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	if !strings.HasPrefix(s, "P") {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	s = s[1:]
+	var d time.Duration
+	inTime := false
+	num := ""
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			num += string(c)
+			continue
+		case c == 'T':
+			inTime = true
+			continue
+		}
+		n, err := strconv.Atoi(num)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		num = ""
+		switch {
+		case c == 'W' && !inTime:
+			d += time.Duration(n) * 7 * 24 * time.Hour
+		case c == 'D' && !inTime:
+			d += time.Duration(n) * 24 * time.Hour
+		case c == 'H' && inTime:
+			d += time.Duration(n) * time.Hour
+		case c == 'M' && inTime:
+			d += time.Duration(n) * time.Minute
+		case c == 'S' && inTime:
+			d += time.Duration(n) * time.Second
+		default:
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+	}
+	if num != "" {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	if negative {
+		d = -d
+	}
+	return d, nil
+}
+
+// applyOverrides removes the instances that have their own VEVENT with a
+// RECURRENCE-ID from the recurring events they belong to
+func (c *ICSCalendar) applyOverrides() {
+	masters := make(map[string]*icsEvent)
+	for _, e := range c.events {
+		if e.recurrenceID.IsZero() && e.rule != nil {
+			masters[e.uid] = e
+		}
+	}
+	for _, e := range c.events {
+		if e.recurrenceID.IsZero() {
+			continue
+		}
+		if m, ok := masters[e.uid]; ok {
+			if m.allDay {
+				m.exDates[e.recurrenceID.Format(time.DateOnly)] = true
+			} else {
+				m.exTimes[e.recurrenceID.Unix()] = true
+			}
+		}
+	}
+}
+
+// Events lists the event instances that overlap the window
+func (c *ICSCalendar) Events(timeMin, timeMax time.Time) []*calendar.Event {
+	var events []*calendar.Event
+	for _, e := range c.events {
+		events = append(events, e.instances(timeMin, timeMax)...)
+	}
+	return events
+}
+
+// Stops runaway rules, a daily rule lists about 27 years from the window
+const maxRecurrenceSteps = 10000
+
+func (e *icsEvent) instances(timeMin, timeMax time.Time) []*calendar.Event {
+	if e.rule == nil {
+		if e.overlaps(e.start, timeMin, timeMax) {
+			return []*calendar.Event{e.instance(e.start, false)}
+		}
+		return nil
+	}
+
+	// Instances that start a little before the window can still overlap it
+	lookback := e.length + 24*time.Hour
+	if e.allDay {
+		lookback = time.Duration(e.days+1) * 24 * time.Hour
+	}
+	var events []*calendar.Event
+	for _, start := range e.rule.starts(e.start, timeMin.Add(-lookback), timeMax) {
+		if e.excluded(start) || !e.overlaps(start, timeMin, timeMax) {
+			continue
+		}
+		events = append(events, e.instance(start, true))
+	}
+	return events
+}
+
+func (e *icsEvent) end(start time.Time) time.Time {
+	if e.allDay {
+		return start.AddDate(0, 0, e.days)
+	}
+	return start.Add(e.length)
+}
+
+func (e *icsEvent) overlaps(start, timeMin, timeMax time.Time) bool {
+	if e.allDay {
+		// All day dates are compared in the zone of the window
+		startDay := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, timeMin.Location())
+		return startDay.Before(timeMax) && startDay.AddDate(0, 0, e.days).After(timeMin)
+	}
+	end := e.end(start)
+	// Events without a length still mark their moment
+	return start.Before(timeMax) && (end.After(timeMin) || (e.length == 0 && !start.Before(timeMin)))
+}
+
+func (e *icsEvent) excluded(start time.Time) bool {
+	return e.exTimes[start.Unix()] || e.exDates[start.Format(time.DateOnly)]
+}
+
+func (e *icsEvent) instance(start time.Time, recurring bool) *calendar.Event {
+	ev := &calendar.Event{
+		Id:           e.uid,
+		ICalUID:      e.uid,
+		Summary:      e.summary,
+		Location:     e.location,
+		Description:  e.description,
+		Status:       e.status,
+		Transparency: e.transparency,
+	}
+	switch {
+	case recurring:
+		ev.RecurringEventId = e.uid
+		ev.Id = e.uid + "_" + start.UTC().Format("20060102T150405Z")
+	case !e.recurrenceID.IsZero():
+		ev.RecurringEventId = e.uid
+		ev.Id = e.uid + "_" + e.recurrenceID.UTC().Format("20060102T150405Z")
+	}
+	if e.allDay {
+		ev.Start = &calendar.EventDateTime{Date: start.Format(time.DateOnly)}
+		ev.End = &calendar.EventDateTime{Date: e.end(start).Format(time.DateOnly)}
+		return ev
+	}
+	ev.Start = &calendar.EventDateTime{DateTime: start.Format(time.RFC3339)}
+	ev.End = &calendar.EventDateTime{DateTime: e.end(start).Format(time.RFC3339)}
+	if start.Location() != time.Local {
+		ev.Start.TimeZone = start.Location().String()
+		ev.End.TimeZone = start.Location().String()
+	}
+	return ev
+}
+
+// recurrence is an RRULE with daily, weekly, monthly or yearly frequency
+type recurrence struct {
+	freq     string
+	interval int
+	count    int
+	// Last possible start, zero if the rule does not end
+	until time.Time
+	// The until is a date, which includes that whole day
+	untilDate  bool
+	byDay      []weekdayNum
+	byMonthDay []int
+	byMonth    []time.Month
+	bySetPos   []int
+}
+
+// weekdayNum is a BYDAY entry such as MO, 2TU or -1FR, n is zero for every one
+type weekdayNum struct {
+	n   int
+	day time.Weekday
+}
+
+var icsWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+func parseRecurrence(value string, loc *time.Location) (*recurrence, error) {
+	r := &recurrence{interval: 1}
+	for _, part := range strings.Split(value, ";") {
+		k, v, _ := strings.Cut(part, "=")
+		var err error
+		switch strings.ToUpper(k) {
+		case "FREQ":
+			r.freq = strings.ToUpper(v)
+		case "INTERVAL":
+			r.interval, err = strconv.Atoi(v)
+			if err == nil && r.interval < 1 {
+				err = fmt.Errorf("invalid interval %q", v)
+			}
+		case "COUNT":
+			r.count, err = strconv.Atoi(v)
+		case "UNTIL":
+			r.until, r.untilDate, err = parseICSTime(icsProperty{"UNTIL", nil, v}, loc)
+		case "BYDAY":
+			for _, d := range strings.Split(v, ",") {
+				day, ok := icsWeekdays[strings.ToUpper(d[max(0, len(d)-2):])]
+				if !ok {
+					return nil, fmt.Errorf("invalid BYDAY %q", d)
+				}
+				n := 0
+				if num := strings.TrimPrefix(d[:len(d)-2], "+"); num != "" {
+					n, err = strconv.Atoi(num)
+				}
+				r.byDay = append(r.byDay, weekdayNum{n, day})
+			}
+		case "BYMONTHDAY":
+			r.byMonthDay, err = parseICSInts(v)
+		case "BYMONTH":
+			var months []int
+			months, err = parseICSInts(v)
+			for _, m := range months {
+				r.byMonth = append(r.byMonth, time.Month(m))
+			}
+		case "BYSETPOS":
+			r.bySetPos, err = parseICSInts(v)
+		case "WKST":
+			// Weeks start on Monday, other starts only matter for rare rules
+		default:
+			return nil, fmt.Errorf("%v is not supported", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v: %w", k, err)
+		}
+	}
+	switch r.freq {
+	case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+	default:
+		return nil, fmt.Errorf("frequency %q is not supported", r.freq)
+	}
+	return r, nil
+}
+
+func parseICSInts(value string) ([]int, error) {
+	var ints []int
+	for _, s := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(strings.TrimPrefix(s, "+"))
+		if err != nil {
+			return nil, err
+		}
+		ints = append(ints, n)
+	}
+	return ints, nil
+}
+
+// starts lists the starts of the rule in order, from the first one up to
+// timeMax. Without COUNT the periods before earliest are skipped, with it
+// they are needed to count. Excluded instances are listed too since they
+// count for COUNT
+func (r *recurrence) starts(first, earliest, timeMax time.Time) []time.Time {
+	starts := []time.Time{first}
+	firstDay := civilDay(first)
+	skip := 0
+	if r.count == 0 {
+		skip = r.stepsBefore(firstDay, civilDay(earliest))
+	}
+	for step := skip; step < skip+maxRecurrenceSteps; step++ {
+		for _, day := range r.periodDays(firstDay, step) {
+			if !day.After(firstDay) {
+				continue
+			}
+			start := time.Date(day.Year(), day.Month(), day.Day(), first.Hour(), first.Minute(), first.Second(), 0, first.Location())
+			if r.ended(start) || !start.Before(timeMax) {
+				return starts
+			}
+			starts = append(starts, start)
+			if r.count > 0 && len(starts) >= r.count {
+				return starts
+			}
+		}
+	}
+	return starts
+}
+
+// stepsBefore is how many periods of the rule pass entirely between the
+// first day and day
+func (r *recurrence) stepsBefore(first, day time.Time) int {
+	if !day.After(first) {
+		return 0
+	}
+	var periods int
+	switch r.freq {
+	case "DAILY":
+		periods = int(day.Sub(first).Hours() / 24)
+	case "WEEKLY":
+		periods = int(day.Sub(first).Hours()/24) / 7
+	case "MONTHLY":
+		periods = (day.Year()-first.Year())*12 + int(day.Month()) - int(first.Month())
+	case "YEARLY":
+		periods = day.Year() - first.Year()
+	}
+	// The period of day itself is kept
+	return max(0, periods/r.interval-1)
+}
+
+func (r *recurrence) ended(start time.Time) bool {
+	if r.until.IsZero() {
+		return false
+	}
+	if r.untilDate {
+		return civilDay(start).After(r.until)
+	}
+	return start.After(r.until)
+}
+
+// civilDay is the date of t as midnight UTC
+func civilDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// periodDays lists the matching days of the period that is step intervals
+// after the one of the first day
+func (r *recurrence) periodDays(first time.Time, step int) []time.Time {
+	var from, to time.Time
+	switch r.freq {
+	case "DAILY":
+		from = first.AddDate(0, 0, step*r.interval)
+		to = from.AddDate(0, 0, 1)
+	case "WEEKLY":
+		monday := first.AddDate(0, 0, -((int(first.Weekday()) + 6) % 7))
+		from = monday.AddDate(0, 0, 7*step*r.interval)
+		to = from.AddDate(0, 0, 7)
+	case "MONTHLY":
+		from = time.Date(first.Year(), first.Month()+time.Month(step*r.interval), 1, 0, 0, 0, 0, time.UTC)
+		to = from.AddDate(0, 1, 0)
+	case "YEARLY":
+		from = time.Date(first.Year()+step*r.interval, 1, 1, 0, 0, 0, 0, time.UTC)
+		to = from.AddDate(1, 0, 0)
+	}
+
+	var days []time.Time
+	for d := from; d.Before(to); d = d.AddDate(0, 0, 1) {
+		days = append(days, d)
+	}
+	if len(r.byMonth) > 0 {
+		days = slices.DeleteFunc(days, func(d time.Time) bool { return !slices.Contains(r.byMonth, d.Month()) })
+	}
+	if len(r.byMonthDay) > 0 {
+		days = slices.DeleteFunc(days, func(d time.Time) bool {
+			last := time.Date(d.Year(), d.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+			for _, n := range r.byMonthDay {
+				if n == d.Day() || (n < 0 && last+n+1 == d.Day()) {
+					return false
+				}
+			}
+			return true
+		})
+	}
+	if len(r.byDay) > 0 {
+		days = r.filterByDay(days)
+	}
+	// Without rules that pick days the day of the first instance repeats
+	if len(r.byDay) == 0 && len(r.byMonthDay) == 0 {
+		days = slices.DeleteFunc(days, func(d time.Time) bool {
+			switch r.freq {
+			case "WEEKLY":
+				return d.Weekday() != first.Weekday()
+			case "MONTHLY":
+				return d.Day() != first.Day()
+			case "YEARLY":
+				return d.Day() != first.Day() || (len(r.byMonth) == 0 && d.Month() != first.Month())
+			}
+			return false
+		})
+	}
+	if len(r.bySetPos) > 0 {
+		var picked []time.Time
+		for _, pos := range r.bySetPos {
+			i := pos - 1
+			if pos < 0 {
+				i = len(days) + pos
+			}
+			if i >= 0 && i < len(days) {
+				picked = append(picked, days[i])
+			}
+		}
+		slices.SortFunc(picked, func(a, b time.Time) int { return a.Compare(b) })
+		days = slices.Compact(picked)
+	}
+	return days
+}
+
+// filterByDay keeps the days on the BYDAY weekdays. Numbered entries count
+// within the month, or within the year for yearly rules without BYMONTH
+func (r *recurrence) filterByDay(days []time.Time) []time.Time {
+	scope := func(d time.Time) int {
+		if r.freq == "YEARLY" && len(r.byMonth) == 0 {
+			return d.Year()
+		}
+		return d.Year()*12 + int(d.Month())
+	}
+	keep := make(map[time.Time]bool)
+	for _, wd := range r.byDay {
+		// The days of each scope with this weekday, in order
+		groups := make(map[int][]time.Time)
+		var order []int
+		for _, d := range days {
+			if d.Weekday() != wd.day {
+				continue
+			}
+			s := scope(d)
+			if _, ok := groups[s]; !ok {
+				order = append(order, s)
+			}
+			groups[s] = append(groups[s], d)
+		}
+		for _, s := range order {
+			matching := groups[s]
+			switch {
+			case wd.n == 0 || (r.freq != "MONTHLY" && r.freq != "YEARLY"):
+				for _, d := range matching {
+					keep[d] = true
+				}
+			case wd.n > 0 && wd.n <= len(matching):
+				keep[matching[wd.n-1]] = true
+			case wd.n < 0 && -wd.n <= len(matching):
+				keep[matching[len(matching)+wd.n]] = true
+			}
+		}
+	}
+	return slices.DeleteFunc(days, func(d time.Time) bool { return !keep[d] })
+}
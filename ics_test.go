@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseICSSkipsAlarms(t *testing.T) {
+	data := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"BEGIN:VEVENT",
+		"UID:review@example.com",
+		"SUMMARY:Site review",
+		"DESCRIPTION:Walk the site",
+		"DTSTART:20300305T140000Z",
+		"DTEND:20300305T160000Z",
+		"BEGIN:VALARM",
+		"ACTION:DISPLAY",
+		"SUMMARY:Reminder",
+		"DESCRIPTION:This is an event reminder",
+		"TRIGGER:-PT10M",
+		"DURATION:PT5M",
+		"END:VALARM",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n")
+	cal, err := ParseICS(strings.NewReader(data), time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := cal.Events(time.Date(2030, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2030, 3, 10, 0, 0, 0, 0, time.UTC))
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+	e := events[0]
+	if e.Summary != "Site review" || e.Description != "Walk the site" {
+		t.Errorf("got summary %q and description %q from the alarm", e.Summary, e.Description)
+	}
+	start, end, ok := eventTimes(e, time.UTC)
+	if !ok || end.Sub(start) != 2*time.Hour {
+		t.Errorf("got %v to %v, want two hours", start, end)
+	}
+}
+
+func TestParseICSRecurrence(t *testing.T) {
+	tests := []struct {
+		name     string
+		lines    []string
+		min, max time.Time
+		want     []string
+	}{
+		{
+			name:  "daily series that started long before the window",
+			lines: []string{"DTSTART:19900101T090000Z", "DTEND:19900101T100000Z", "RRULE:FREQ=DAILY"},
+			min:   time.Date(2030, 6, 3, 0, 0, 0, 0, time.UTC),
+			max:   time.Date(2030, 6, 5, 0, 0, 0, 0, time.UTC),
+			want:  []string{"2030-06-03T09:00:00Z", "2030-06-04T09:00:00Z"},
+		},
+		{
+			name:  "instance that starts before the window and ends in it",
+			lines: []string{"DTSTART:20000101T230000Z", "DTEND:20000102T010000Z", "RRULE:FREQ=WEEKLY;INTERVAL=2"},
+			min:   time.Date(2030, 1, 6, 0, 0, 0, 0, time.UTC),
+			max:   time.Date(2030, 1, 6, 12, 0, 0, 0, time.UTC),
+			want:  []string{"2030-01-05T23:00:00Z"},
+		},
+		{
+			name:  "count with an excluded instance",
+			lines: []string{"DTSTART:20300101T090000Z", "DURATION:PT1H", "RRULE:FREQ=DAILY;COUNT=3", "EXDATE:20300102T090000Z"},
+			min:   time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+			max:   time.Date(2030, 2, 1, 0, 0, 0, 0, time.UTC),
+			want:  []string{"2030-01-01T09:00:00Z", "2030-01-03T09:00:00Z"},
+		},
+		{
+			name:  "last friday of the month",
+			lines: []string{"DTSTART:20300104T150000Z", "DURATION:PT1H", "RRULE:FREQ=MONTHLY;BYDAY=-1FR;UNTIL=20300331"},
+			min:   time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+			max:   time.Date(2030, 12, 1, 0, 0, 0, 0, time.UTC),
+			want:  []string{"2030-01-04T15:00:00Z", "2030-01-25T15:00:00Z", "2030-02-22T15:00:00Z", "2030-03-29T15:00:00Z"},
+		},
+		{
+			name:  "leap day every year",
+			lines: []string{"DTSTART:20280229T120000Z", "DURATION:PT1H", "RRULE:FREQ=YEARLY"},
+			min:   time.Date(2028, 1, 1, 0, 0, 0, 0, time.UTC),
+			max:   time.Date(2037, 1, 1, 0, 0, 0, 0, time.UTC),
+			want:  []string{"2028-02-29T12:00:00Z", "2032-02-29T12:00:00Z", "2036-02-29T12:00:00Z"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := append([]string{"BEGIN:VCALENDAR", "BEGIN:VEVENT", "UID:series", "SUMMARY:Series"}, tt.lines...)
+			lines = append(lines, "END:VEVENT", "END:VCALENDAR")
+			cal, err := ParseICS(strings.NewReader(strings.Join(lines, "\r\n")), time.UTC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range cal.Events(tt.min, tt.max) {
+				start, _, _ := eventTimes(e, time.UTC)
+				got = append(got, start.Format(time.RFC3339))
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
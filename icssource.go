@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+const (
+	icsBucket = "icsCalendars"
+	// Calendar ids with this prefix are read from the iCalendar files
+	icsPrefix = "ics:"
+	// Largest iCalendar file that can be uploaded
+	maxICSUpload = 10 << 20
+)
+
+var icsNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func validateICSName(name string) error {
+	if !icsNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid calendar name %q, use up to 64 letters, digits, dots, dashes and underscores", name)
+	}
+	return nil
+}
+
+// ICSSource serves calendars from iCalendar files. Uploaded files are kept
+// in the store and belong to the user that uploaded them, local files are
+// read again when they change and every user can read them
+type ICSSource struct {
+	mu sync.RWMutex
+	// Local files by name, uploads by owner and name
+	calendars map[string]*icsEntry
+	store     *Store
+	// Zone of the times in the files that have none
+	loc *time.Location
+}
+
+// uploadKey is where the upload of the owner is kept, calendar names
+// cannot contain a slash so they never clash with local files
+func uploadKey(owner, name string) string {
+	return owner + "/" + name
+}
+
+type icsEntry struct {
+	cal *ICSCalendar
+	// Path of a local file, empty for uploads
+	path    string
+	modTime time.Time
+}
+
+func NewICSSource(store *Store, loc *time.Location) *ICSSource {
+	return &ICSSource{calendars: make(map[string]*icsEntry), store: store, loc: loc}
+}
+
+// LoadUploads parses the files that were uploaded before
+func (s *ICSSource) LoadUploads() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.store.ForEach(icsBucket, func(key string, data []byte) error {
+		if !strings.Contains(key, "/") {
+			logger.Println("Skipping uploaded calendar without an owner", key)
+			return nil
+		}
+		cal, err := ParseICS(bytes.NewReader(data), s.loc)
+		if err != nil {
+			logger.Println("Unable to parse uploaded calendar", key, err)
+			return nil
+		}
+		s.calendars[key] = &icsEntry{cal: cal}
+		return nil
+	})
+}
+
+// AddFile serves the local file under the name
+func (s *ICSSource) AddFile(name, path string) error {
+	if err := validateICSName(name); err != nil {
+		return err
+	}
+	entry := &icsEntry{path: path}
+	if err := s.reload(entry); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calendars[name] = entry
+	return nil
+}
+
+func (s *ICSSource) reload(entry *icsEntry) error {
+	info, err := os.Stat(entry.path)
+	if err != nil {
+		return err
+	}
+	if entry.cal != nil && info.ModTime().Equal(entry.modTime) {
+		return nil
+	}
+	f, err := os.Open(entry.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cal, err := ParseICS(f, s.loc)
+	if err != nil {
+		return fmt.Errorf("%v: %w", entry.path, err)
+	}
+	entry.cal, entry.modTime = cal, info.ModTime()
+	return nil
+}
+
+// Upload parses the file and keeps it under the owner and name, replacing
+// an earlier upload of the owner
+func (s *ICSSource) Upload(owner, name string, data []byte) (*ICSCalendar, error) {
+	if err := validateICSName(name); err != nil {
+		return nil, err
+	}
+	if owner == "" {
+		return nil, fmt.Errorf("calendars can only be uploaded by a user")
+	}
+	cal, err := ParseICS(bytes.NewReader(data), s.loc)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.calendars[name]; ok {
+		return nil, fmt.Errorf("calendar %q is a local file", name)
+	}
+	key := uploadKey(owner, name)
+	if err := s.store.Put(icsBucket, key, data); err != nil {
+		return nil, err
+	}
+	s.calendars[key] = &icsEntry{cal: cal}
+	return cal, nil
+}
+
+// Remove deletes an upload of the owner
+func (s *ICSSource) Remove(owner, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.calendars[name]; ok {
+		return fmt.Errorf("calendar %q is a local file", name)
+	}
+	key := uploadKey(owner, name)
+	if _, ok := s.calendars[key]; !ok || owner == "" {
+		return fmt.Errorf("calendar %q not found", name)
+	}
+	if err := s.store.Delete(icsBucket, key); err != nil {
+		return err
+	}
+	delete(s.calendars, key)
+	return nil
+}
+
+// For is the view of the calendars the owner can read, an empty owner
+// only sees the local files
+func (s *ICSSource) For(owner string) *ICSView {
+	return &ICSView{source: s, owner: owner}
+}
+
+// ICSView serves the uploads of one user and the local files
+type ICSView struct {
+	source *ICSSource
+	owner  string
+}
+
+func (v *ICSView) calendar(name string) (*ICSCalendar, error) {
+	s := v.source
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.calendars[name]
+	if !ok && v.owner != "" && validateICSName(name) == nil {
+		entry, ok = s.calendars[uploadKey(v.owner, name)]
+	}
+	if !ok {
+		return nil, fmt.Errorf("calendar %q not found", name)
+	}
+	if entry.path != "" {
+		if err := s.reload(entry); err != nil {
+			// The last good version is kept
+			logger.Println("Unable to reload calendar", name, err)
+		}
+	}
+	return entry.cal, nil
+}
+
+func (v *ICSView) ListCalendars(ctx context.Context) ([]*calendar.CalendarListEntry, bool, error) {
+	s := v.source
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	prefix := uploadKey(v.owner, "")
+	var cals []*calendar.CalendarListEntry
+	for key, entry := range s.calendars {
+		name, upload := strings.CutPrefix(key, prefix)
+		if !upload && entry.path == "" {
+			// Someone else's upload
+			continue
+		}
+		if upload && v.owner == "" {
+			continue
+		}
+		summary := entry.cal.Name
+		if summary == "" {
+			summary = name
+		}
+		cals = append(cals, &calendar.CalendarListEntry{Id: name, Summary: summary, AccessRole: "reader"})
+	}
+	sort.Slice(cals, func(i, j int) bool { return cals[i].Id < cals[j].Id })
+	return cals, false, nil
+}
+
+func (v *ICSView) ListEvents(ctx context.Context, calID string, timeMin, timeMax time.Time) ([]*calendar.Event, bool, error) {
+	cal, err := v.calendar(calID)
+	if err != nil {
+		return nil, false, err
+	}
+	events := cal.Events(timeMin, timeMax)
+	sort.Slice(events, func(i, j int) bool {
+		return eventStartsBefore(events[i], events[j], timeMin.Location())
+	})
+	return events, false, nil
+}
+
+func (v *ICSView) FreeBusy(ctx context.Context, calIDs []string, timeMin, timeMax time.Time) (map[string][]*calendar.TimePeriod, error) {
+	return freeBusyFromEvents(ctx, v, calIDs, timeMin, timeMax)
+}
+
+// icsCalendars lists the iCalendar calendars the user can read on GET,
+// uploads the body under the name parameter on POST and removes one of the
+// user's uploads on DELETE
+func icsCalendars(ss ServerState) func(rw http.ResponseWriter, req *http.Request) {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		token, _, ok := ss.userSource(rw, req)
+		if !ok {
+			return
+		}
+		owner := ss.owner(token)
+		name := req.URL.Query().Get("name")
+		switch req.Method {
+		case http.MethodGet:
+			cals, _, _ := ss.ics.For(owner).ListCalendars(req.Context())
+			for _, c := range cals {
+				c.Id = icsPrefix + c.Id
+			}
+			rw.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(rw).Encode(cals)
+		case http.MethodPost:
+			defer req.Body.Close()
+			data, err := io.ReadAll(http.MaxBytesReader(rw, req.Body, maxICSUpload))
+			if err != nil {
+				http.Error(rw, "Unable to read the calendar: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			cal, err := ss.ics.Upload(owner, name, data)
+			if err != nil {
+				http.Error(rw, "Unable to add the calendar: "+err.Error(), http.StatusBadRequest)
+				logger.Println("Unable to add the calendar", err)
+				return
+			}
+			summary := cal.Name
+			if summary == "" {
+				summary = name
+			}
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(http.StatusCreated)
+			json.NewEncoder(rw).Encode(&calendar.CalendarListEntry{Id: icsPrefix + name, Summary: summary, AccessRole: "reader"})
+		case http.MethodDelete:
+			if err := ss.ics.Remove(owner, name); err != nil {
+				http.Error(rw, err.Error(), http.StatusNotFound)
+				return
+			}
+			rw.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(rw, "Only GET, POST and DELETE are allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestICSUploadsBelongToTheirOwner(t *testing.T) {
+	store, err := OpenStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	src := NewICSSource(store, time.UTC)
+	data := []byte("BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:a\r\nSUMMARY:Private\r\nDTSTART:20300101T090000Z\r\nDTEND:20300101T100000Z\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n")
+	if _, err := src.Upload("alice@example.com", "work", data); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	min, max := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)
+	if events, _, err := src.For("alice@example.com").ListEvents(ctx, "work", min, max); err != nil || len(events) != 1 {
+		t.Errorf("owner got %d events, %v", len(events), err)
+	}
+	bob := src.For("bob@example.com")
+	if _, _, err := bob.ListEvents(ctx, "work", min, max); err == nil {
+		t.Error("another user read the upload")
+	}
+	if cals, _, _ := bob.ListCalendars(ctx); len(cals) != 0 {
+		t.Errorf("another user listed %d calendars", len(cals))
+	}
+	if err := src.Remove("bob@example.com", "work"); err == nil {
+		t.Error("another user removed the upload")
+	}
+	if _, err := src.Upload("bob@example.com", "work", data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Uploads are loaded again under their owners
+	reloaded := NewICSSource(store, time.UTC)
+	if err := reloaded.LoadUploads(); err != nil {
+		t.Fatal(err)
+	}
+	if cals, _, _ := reloaded.For("alice@example.com").ListCalendars(ctx); len(cals) != 1 || cals[0].Id != "work" {
+		t.Errorf("owner listed %v after reloading", cals)
+	}
+	if err := reloaded.Remove("alice@example.com", "work"); err != nil {
+		t.Error(err)
+	}
+	if _, _, err := reloaded.For("bob@example.com").ListEvents(ctx, "work", min, max); err != nil {
+		t.Error("removing one upload removed the other user's", err)
+	}
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -12,18 +20,18 @@ import (
 
 func authStatus(ss ServerState) func(rw http.ResponseWriter, req *http.Request) {
 	return func(rw http.ResponseWriter, req *http.Request) {
-		cookie, err := req.Cookie("authCodeEvPlanner")
-		if err != nil {
-			http.Error(rw, "No auth code found", http.StatusUnauthorized)
+		token, ok := ss.sessionID(req)
+		if !ok {
+			http.Error(rw, "No session cookie found", http.StatusUnauthorized)
 			return
 		}
-		authCode := cookie.Value
-		token := SessionToken(authCode)
-		_, ok := ss.sessions[token]
+		_, ok, err := ss.sessions.Get(token)
+		if err != nil {
+			logger.Println("Unable to load session", err)
+		}
 		if !ok {
 			// Remove the cookie if the session is not found
-			cookie.Expires = time.Now().Add(-1 * time.Hour)
-			http.SetCookie(rw, cookie)
+			ss.clearCookie(rw, sessionCookie)
 			http.Error(rw, "No valid session found", http.StatusUnauthorized)
 			return
 		}
@@ -33,39 +41,112 @@ func authStatus(ss ServerState) func(rw http.ResponseWriter, req *http.Request)
 		json.NewEncoder(rw).Encode(map[string]bool{"authenticated": true})
 	}
 }
-func main() {
 
-	// opts := initializeOptions()
-	// findSlots(opts)
+// logger writes the diagnostics of the code shared by the server and the
+// command line tools, the tools send them to stderr to keep stdout for
+// their output
+var logger = log.New(os.Stdout, "", 0)
+
+func main() {
 	err := godotenv.Load("./.env")
-	if err != nil {
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		log.Fatal("Error loading .env file")
 	}
 
-	ss := createServerState()
+	// Without a command the server is started, as it always was
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	if cmd == "serve" {
+		serve(args)
+		return
+	}
+	if err := runCommand(cmd, args); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+}
+
+// serve runs the web server until it is interrupted
+func serve(args []string) {
+	cfg, err := loadServerConfig(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.Print()
+	ss := createServerState(cfg)
 
 	http.HandleFunc("/login", loginUser(ss))
 	http.HandleFunc("/authcallback", authCallback(ss))
 	http.HandleFunc("/authStatus", authStatus(ss))
 	http.HandleFunc("/queryAvailableSlots", queryAvailableSlots(ss))
 	http.HandleFunc("/listCalendars", listCalendars(ss))
+	http.HandleFunc("/cacheStats", cacheStats(ss))
+	http.HandleFunc("/bookSlot", bookSlot(ss))
+	http.HandleFunc("/holds", holds(ss))
+	http.HandleFunc("/holds/confirm", confirmHold(ss))
+	http.HandleFunc("/holds/release", releaseHold(ss))
+	http.HandleFunc("/groups", groups(ss))
+	http.HandleFunc("/groups/join", joinGroup(ss))
+	http.HandleFunc("/groups/leave", leaveGroup(ss))
+	http.HandleFunc("/groupSlots", queryGroupSlots(ss))
+	http.HandleFunc("/icsCalendars", icsCalendars(ss))
 	http.HandleFunc("/removecookie", func(rw http.ResponseWriter, req *http.Request) {
-		cookie, err := req.Cookie("authCodeEvPlanner")
-		if err != nil {
-			http.Error(rw, "No auth code found", http.StatusUnauthorized)
+		token, ok := ss.sessionID(req)
+		if !ok {
+			http.Error(rw, "No session cookie found", http.StatusUnauthorized)
 			return
 		}
-		cookie.Expires = time.Now().Add(-1 * time.Hour)
-		cookie.Value = ""
-		http.SetCookie(rw, cookie)
+		// Logging out ends the session on the server as well
+		if err := ss.sessions.Delete(token); err != nil {
+			logger.Println("Unable to delete session", err)
+		}
+		ss.clearCookie(rw, sessionCookie)
 		http.Redirect(rw, req, "/", http.StatusFound)
 	})
-	http.Handle("/", staticFileServer())
-	fmt.Println("Server started on localhost:8080")
-	err = http.ListenAndServe("localhost:8080", nil)
-	if err != nil {
+	http.Handle("/", staticFileServer(cfg.Server.StaticDir))
+
+	stopSweeper := startSweeper(ss.sessions, ss.pending, ss.cache, time.Minute)
+	stopReleaser := startHoldReleaser(ss, time.Minute)
+	srv := &http.Server{Addr: cfg.Server.ListenAddr}
+
+	// Stop serving and sweeping once interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		logger.Println("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logger.Println("Unable to shut down cleanly", err)
+		}
+	}()
+
+	logger.Println("Server started on", cfg.Server.ListenAddr)
+	err = srv.ListenAndServe()
+	if err != http.ErrServerClosed {
 		log.Fatal("Error starting server")
 	}
+	// Wait for the requests in flight before closing the database
+	<-shutdownDone
+	stopSweeper()
+	stopReleaser()
+	// Without a session key the holds cannot be reached after a restart,
+	// so they are released now instead of being left behind in the calendars
+	if !ss.holds.Durable() {
+		if released := ss.holds.ReleaseAll(ss.ctx, ss.sourceFor); released > 0 {
+			logger.Println("Released", released, "hold groups")
+		}
+	}
+	if err := ss.store.Close(); err != nil {
+		logger.Println("Unable to close the database", err)
+	}
 	// Make a http server that does the following:
 	// 1. Authorize users that login into the login endpoint
 	// 2. Authorized users can use the jwt they've been given to get a list of their calendars,
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Detour that halves the travel rating
+	travelScale = 30 * time.Minute
+	// Spare time in a slot that gets the full buffer rating
+	bufferTarget = 30 * time.Minute
+	// Distance from the preferred time where the time of day rating drops to zero
+	timeOfDaySpan = 6 * time.Hour
+)
+
+// ScoreWeights weighs the components of the score of a slot, a component
+// with a weight of zero is left out
+type ScoreWeights struct {
+	// Less travel added to the day
+	Travel float64
+	// Closer to the preferred time of day
+	TimeOfDay float64
+	// Sooner in the searched days
+	Proximity float64
+	// Filling more of the free window, leaving fewer unusable pieces, or
+	// being next to an event when adjacent times are preferred
+	Fragmentation float64
+	// More spare time around the event
+	Buffer float64
+}
+
+// DefaultScoreWeights mostly ranks by travel, like before the other
+// components were added
+func DefaultScoreWeights() ScoreWeights {
+	return ScoreWeights{Travel: 4, TimeOfDay: 1, Proximity: 1, Fragmentation: 1, Buffer: 1}
+}
+
+func (w ScoreWeights) validate() error {
+	for _, v := range []float64{w.Travel, w.TimeOfDay, w.Proximity, w.Fragmentation, w.Buffer} {
+		if v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("weights must be finite and not negative")
+		}
+	}
+	return nil
+}
+
+// parseScoreWeights reads weights written as "travel=4,buffer=0", the
+// components that are not given keep their default weight
+func parseScoreWeights(s string) (ScoreWeights, error) {
+	w := DefaultScoreWeights()
+	if strings.TrimSpace(s) == "" {
+		return w, nil
+	}
+	fields := map[string]*float64{
+		"travel":        &w.Travel,
+		"time":          &w.TimeOfDay,
+		"proximity":     &w.Proximity,
+		"fragmentation": &w.Fragmentation,
+		"buffer":        &w.Buffer,
+	}
+	for _, part := range strings.Split(s, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(part), "=")
+		field, ok := fields[strings.ToLower(name)]
+		if !found || !ok {
+			return ScoreWeights{}, fmt.Errorf("invalid weight %q, expected travel, time, proximity, fragmentation or buffer=number", part)
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return ScoreWeights{}, fmt.Errorf("invalid weight %q: %w", part, err)
+		}
+		*field = v
+	}
+	return w, w.validate()
+}
+
+// SlotScore is the score of a slot, higher is better. Each component is
+// its weight times a rating from 0 to 1, and Total is their sum
+type SlotScore struct {
+	Total         float64
+	Travel        float64
+	TimeOfDay     float64
+	Proximity     float64
+	Fragmentation float64
+	Buffer        float64
+}
+
+// scoreSlot rates the slot found in the search starting on first
+func scoreSlot(slot LocatedTimeSlot, first Date, opts Opts) SlotScore {
+	w := opts.weights
+	var s SlotScore
+
+	detour := max(slot.Detour, 0)
+	s.Travel = w.Travel * float64(travelScale) / float64(travelScale+detour)
+
+	if opts.prefer != nil {
+		// Slots are in the zone of the working hours
+		start := slot.Start
+		minutes := time.Duration(start.Hour()*60+start.Minute()) * time.Minute
+		off := (minutes - time.Duration(*opts.prefer)*time.Minute).Abs()
+		s.TimeOfDay = w.TimeOfDay * max(0, 1-float64(off)/float64(timeOfDaySpan))
+	}
+
+	if opts.numDays > 0 {
+		day := math.Round(slot.Date.Time().Sub(first.Time()).Hours() / 24)
+		s.Proximity = w.Proximity * max(0, 1-day/float64(opts.numDays))
+	}
+
+	if window := slot.gapEnd.Sub(slot.gapStart); window > 0 {
+		s.Fragmentation = w.Fragmentation * fragmentation(slot, window, opts)
+		spare := max(window-opts.duration, 0)
+		s.Buffer = w.Buffer * float64(min(spare, bufferTarget)) / float64(bufferTarget)
+	}
+
+	s.Total = s.Travel + s.TimeOfDay + s.Proximity + s.Fragmentation + s.Buffer
+	return s
+}
+
+// fragmentation rates how much of the free window the event fills. When
+// adjacent times are preferred, a candidate is rated by how close it is to
+// the nearest event of its window instead, from 1 right next to it to 0
+// halfway through the window
+func fragmentation(slot LocatedTimeSlot, window time.Duration, opts Opts) float64 {
+	fill := min(1, float64(opts.duration)/float64(window))
+	spare := window - opts.duration
+	if !opts.preferAdjacent || spare <= 0 {
+		return fill
+	}
+	var gaps []time.Duration
+	afterPrev, beforeNext := slot.adjacent()
+	if afterPrev {
+		gaps = append(gaps, slot.Start.Sub(slot.gapStart))
+	}
+	if beforeNext {
+		gaps = append(gaps, slot.gapEnd.Sub(slot.Start.Add(opts.duration)))
+	}
+	if len(gaps) == 0 {
+		// Nothing to be next to, like on an empty day or with the events
+		// well outside of the working hours
+		return fill
+	}
+	nearest := max(slices.Min(gaps), 0)
+	return max(0, 1-float64(nearest)/(float64(spare)/2))
+}
+
+// compareScores orders the best scores first, then the shortest detours
+func compareScores(i, j LocatedTimeSlot) int {
+	if c := cmp.Compare(j.Score.Total, i.Score.Total); c != 0 {
+		return c
+	}
+	return compareDetours(i, j)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseScoreWeights(t *testing.T) {
+	defaults := DefaultScoreWeights()
+	tests := []struct {
+		in    string
+		want  ScoreWeights
+		fails bool
+	}{
+		{"", defaults, false},
+		{"  ", defaults, false},
+		{"travel=2", ScoreWeights{Travel: 2, TimeOfDay: 1, Proximity: 1, Fragmentation: 1, Buffer: 1}, false},
+		{"Time=3, buffer=0", ScoreWeights{Travel: 4, TimeOfDay: 3, Proximity: 1, Fragmentation: 1, Buffer: 0}, false},
+		{"proximity=0.5,fragmentation=1e1", ScoreWeights{Travel: 4, TimeOfDay: 1, Proximity: 0.5, Fragmentation: 10, Buffer: 1}, false},
+		{"travel", ScoreWeights{}, true},
+		{"speed=1", ScoreWeights{}, true},
+		{"travel=fast", ScoreWeights{}, true},
+		{"travel=-1", ScoreWeights{}, true},
+		{"buffer=NaN", ScoreWeights{}, true},
+		{"buffer=Inf", ScoreWeights{}, true},
+	}
+	for _, test := range tests {
+		got, err := parseScoreWeights(test.in)
+		if (err != nil) != test.fails || !test.fails && got != test.want {
+			t.Errorf("parseScoreWeights(%q) = %+v, %v", test.in, got, err)
+		}
+	}
+}
+
+func TestScoreSlot(t *testing.T) {
+	first := Date{2030, time.January, 7}
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2030, 1, 7+day, hour, minute, 0, 0, time.UTC)
+	}
+	slot := func(day, hour, minute int, detour time.Duration, window time.Duration) LocatedTimeSlot {
+		start := at(day, hour, minute)
+		return LocatedTimeSlot{
+			TimeSlot: TimeSlot{Date: TimeToDate(start), Start: start, End: start.Add(window)},
+			Detour:   detour,
+			gapStart: start,
+			gapEnd:   start.Add(window),
+		}
+	}
+	noon := ClockTime(12 * 60)
+	tests := []struct {
+		name    string
+		slot    LocatedTimeSlot
+		weights ScoreWeights
+		prefer  *ClockTime
+		want    SlotScore
+	}{
+		{"no detour on the first day, filling the window",
+			slot(0, 9, 0, 0, time.Hour), ScoreWeights{Travel: 1, Proximity: 1, Fragmentation: 1, Buffer: 1}, nil,
+			SlotScore{Travel: 1, Proximity: 1, Fragmentation: 1}},
+		{"detour of the travel scale halves the travel",
+			slot(0, 9, 0, travelScale, time.Hour), ScoreWeights{Travel: 4}, nil,
+			SlotScore{Travel: 2}},
+		{"negative detours count as none",
+			slot(0, 9, 0, -10*time.Minute, time.Hour), ScoreWeights{Travel: 4}, nil,
+			SlotScore{Travel: 4}},
+		{"later days are less close",
+			slot(2, 9, 0, 0, time.Hour), ScoreWeights{Proximity: 2}, nil,
+			SlotScore{Proximity: 1}},
+		{"at the preferred time",
+			slot(0, 12, 0, 0, time.Hour), ScoreWeights{TimeOfDay: 3}, &noon,
+			SlotScore{TimeOfDay: 3}},
+		{"three hours from the preferred time",
+			slot(0, 9, 0, 0, time.Hour), ScoreWeights{TimeOfDay: 1}, &noon,
+			SlotScore{TimeOfDay: 0.5}},
+		{"too far from the preferred time",
+			slot(0, 5, 0, 0, time.Hour), ScoreWeights{TimeOfDay: 1}, &noon,
+			SlotScore{}},
+		{"no preferred time",
+			slot(0, 12, 0, 0, time.Hour), ScoreWeights{TimeOfDay: 1}, nil,
+			SlotScore{}},
+		{"half of the window left, more than the buffer target",
+			slot(0, 9, 0, 0, 2*time.Hour), ScoreWeights{Fragmentation: 1, Buffer: 1}, nil,
+			SlotScore{Fragmentation: 0.5, Buffer: 1}},
+		{"some spare time",
+			slot(0, 9, 0, 0, time.Hour+15*time.Minute), ScoreWeights{Buffer: 2}, nil,
+			SlotScore{Buffer: 1}},
+		{"zero weights leave everything out",
+			slot(0, 12, 0, 0, 2*time.Hour), ScoreWeights{}, &noon,
+			SlotScore{}},
+	}
+	for _, test := range tests {
+		opts := Opts{weights: test.weights, prefer: test.prefer, numDays: 4, duration: time.Hour}
+		got := scoreSlot(test.slot, first, opts)
+		test.want.Total = test.want.Travel + test.want.TimeOfDay + test.want.Proximity + test.want.Fragmentation + test.want.Buffer
+		for _, c := range [][2]float64{
+			{got.Total, test.want.Total}, {got.Travel, test.want.Travel}, {got.TimeOfDay, test.want.TimeOfDay},
+			{got.Proximity, test.want.Proximity}, {got.Fragmentation, test.want.Fragmentation}, {got.Buffer, test.want.Buffer},
+		} {
+			if math.Abs(c[0]-c[1]) > 1e-9 {
+				t.Errorf("%v: got %+v, want %+v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestWeightsRankSlots(t *testing.T) {
+	src := NewMemorySource()
+	src.Add("primary", "Primary",
+		testEvent("Morning", "Far", tomorrowAt(9, 0), tomorrowAt(10, 0)),
+		testEvent("Lunch", "Far", tomorrowAt(12, 30), tomorrowAt(13, 0)),
+	)
+	tests := []struct {
+		name    string
+		weights ScoreWeights
+		prefer  ClockTime
+		want    string
+	}{
+		// Between the two events is a round trip to the office
+		{"least travel", ScoreWeights{Travel: 1}, 10 * 60, "13:30"},
+		{"preferred time", ScoreWeights{TimeOfDay: 1}, 10 * 60, "10:30"},
+	}
+	for _, test := range tests {
+		opts := testOpts(src, time.Hour)
+		opts.distances = lineDistance{"Far": 30}
+		opts.weights = test.weights
+		opts.prefer = &test.prefer
+		results, err := findSlots(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results.Slots) == 0 {
+			t.Fatalf("%v: no slots", test.name)
+		}
+		var starts []string
+		for _, s := range results.Slots {
+			starts = append(starts, s.Start.Format("15:04"))
+		}
+		if starts[0] != test.want || !slices.IsSortedFunc(results.Slots, compareScores) {
+			t.Errorf("%v: ranked %v, want %v first", test.name, starts, test.want)
+		}
+	}
+}
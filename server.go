@@ -5,33 +5,188 @@ import (
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
+	"os"
+	"strings"
 	"time"
+	_ "time/tzdata"
 
 	"golang.org/x/oauth2"
-	"google.golang.org/api/calendar/v3"
-	"googlemaps.github.io/maps"
 )
 
 type SessionToken string
 
+// Set on responses whose results were cut off by the page cap, holds
+// the truncated calendar ids for slot queries. JSON slot results also
+// list them in their Truncated field, exports only have the header
+const truncatedHeader = "X-Results-Truncated"
+
 // type UserToken string
 
 type ServerState struct {
 	ctx      context.Context
-	sessions map[SessionToken]*calendar.Service
+	sessions SessionStore
+	// OAuth states of the logins that have not called back yet
+	pending  *LoginStates
 	config   *oauth2.Config
-	mapSvc   *maps.Client
+	distSvc  DistanceProvider
+	defaults *Config
+	store    *Store
+	cache    *Cache
+	signer   *CookieSigner
+	// Tentative holds waiting to be confirmed
+	holds *HoldManager
+	// Users looking for slots together
+	groups *Groups
+	// Calendars from iCalendar files, shared by all users
+	ics *ICSSource
 }
 
-func createServerState() ServerState {
-	config := oauthFromEnv()
+// createServerState sets up the services of a validated config
+func createServerState(defaults *Config) ServerState {
+	config := oauthFromEnv(defaults.Server.RedirectURL)
 	ctx := context.Background()
-	mapSvc := createMapService()
-	ss := ServerState{ctx, make(map[SessionToken]*calendar.Service), config, mapSvc}
+	store, err := OpenStore(defaults.DataPath)
+	if err != nil {
+		log.Fatal("Unable to open the database: ", err)
+	}
+	cache := newConfigCache(defaults, store)
+	serverKey, err := parseServerKey(os.Getenv("SESSION_KEY"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	sessions, err := createSessionStore(store, serverKey)
+	if err != nil {
+		log.Fatal("Unable to create session store: ", err)
+	}
+	signer, err := NewCookieSigner(serverKey)
+	if err != nil {
+		log.Fatal("Unable to create cookie signer: ", err)
+	}
+	distSvc, err := createDistanceProvider(defaults.Routing, cache)
+	if err != nil {
+		log.Fatal("Unable to create distance provider: ", err)
+	}
+	ics, err := createICSSource(defaults, store)
+	if err != nil {
+		log.Fatal("Unable to load the iCalendar files: ", err)
+	}
+	holds, err := NewHoldManager(store, sessions)
+	if err != nil {
+		log.Fatal("Unable to load the holds: ", err)
+	}
+	ss := ServerState{ctx, sessions, NewLoginStates(), config, distSvc, defaults, store, cache, signer, holds, NewGroups(), ics}
 	return ss
 }
 
+// newConfigCache creates the cache with the TTL of the config
+func newConfigCache(defaults *Config, store *Store) *Cache {
+	ttl := time.Duration(defaults.Routing.CacheTTLHours) * time.Hour
+	if ttl == 0 {
+		ttl = 7 * 24 * time.Hour
+	}
+	return NewCache(store, ttl)
+}
+
+// createICSSource loads the uploaded iCalendar files and the local ones of the config
+func createICSSource(defaults *Config, store *Store) (*ICSSource, error) {
+	loc, err := loadLocation(defaults.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	ics := NewICSSource(store, loc)
+	if err := ics.LoadUploads(); err != nil {
+		return nil, err
+	}
+	for name, path := range defaults.ICSFiles {
+		if err := ics.AddFile(name, path); err != nil {
+			return nil, err
+		}
+	}
+	return ics, nil
+}
+
+// sourceFor rebuilds the calendar source of a logged in user
+func (ss ServerState) sourceFor(token SessionToken) (EventSource, bool) {
+	session, found, err := ss.sessions.Get(token)
+	if err != nil {
+		logger.Println("Unable to load session", err)
+		return nil, false
+	}
+	if !found {
+		return nil, false
+	}
+	ts := sessionTokenSource(ss.ctx, ss.config, ss.sessions, token, session)
+	svc, err := newCalendarService(ss.ctx, ts)
+	if err != nil {
+		logger.Println("Unable to create calendar service", err)
+		return nil, false
+	}
+	google := NewGoogleSource(svc, ss.defaults.PageSize, ss.defaults.MaxPages)
+	return &MultiSource{Default: google, Prefixed: map[string]EventSource{icsPrefix: ss.ics.For(sessionOwner(token, session))}}, true
+}
+
+// owner is who owns what the session keeps on the server, the user's
+// account or else the session itself
+func (ss ServerState) owner(token SessionToken) string {
+	session, found, err := ss.sessions.Get(token)
+	if err != nil || !found {
+		return sessionOwner(token, nil)
+	}
+	return sessionOwner(token, session)
+}
+
+func sessionOwner(token SessionToken, session *Session) string {
+	if session != nil && session.User != "" {
+		return session.User
+	}
+	return "session:" + sessionKey(token)
+}
+
+// sessionID reads the session id from the signed session cookie
+func (ss ServerState) sessionID(req *http.Request) (SessionToken, bool) {
+	cookie, err := req.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+	return ss.signer.Verify(cookie.Value)
+}
+
+// userSource loads the calendar source of the request's session, it
+// answers the request itself when there is none
+func (ss ServerState) userSource(rw http.ResponseWriter, req *http.Request) (SessionToken, EventSource, bool) {
+	token, ok := ss.sessionID(req)
+	if !ok {
+		http.Error(rw, "No session cookie found", http.StatusUnauthorized)
+		return "", nil, false
+	}
+	source, ok := ss.sourceFor(token)
+	if !ok {
+		ss.clearCookie(rw, sessionCookie)
+		http.Error(rw, "No valid session found", http.StatusUnauthorized)
+		return "", nil, false
+	}
+	return token, source, true
+}
+
+func (ss ServerState) setCookie(rw http.ResponseWriter, name, value string, lifetime time.Duration) {
+	http.SetCookie(rw, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Domain:   ss.defaults.Server.Domain,
+		Path:     "/",
+		MaxAge:   int(lifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   !ss.defaults.Server.InsecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (ss ServerState) clearCookie(rw http.ResponseWriter, name string) {
+	ss.setCookie(rw, name, "", -time.Second)
+}
+
 func printCookies(rw http.ResponseWriter, req *http.Request) {
 	for _, cookie := range req.Cookies() {
 		fmt.Fprintf(rw, "Cookie: %s\n", cookie)
@@ -52,20 +207,26 @@ func randState() string {
 // Get the auth code from callback to put into cookie
 func loginUser(ss ServerState) func(rw http.ResponseWriter, req *http.Request) {
 	return func(rw http.ResponseWriter, req *http.Request) {
-		if cookie, _ := req.Cookie("authCodeEvPlanner"); cookie != nil && cookie.Value != "" {
+		if id, ok := ss.sessionID(req); ok {
 			// Check if there is a session for the user
-			if _, ok := ss.sessions[SessionToken(cookie.Value)]; ok {
-				fmt.Println("User already logged in")
+			if _, ok, _ := ss.sessions.Get(id); ok {
+				logger.Println("User already logged in")
 				http.Redirect(rw, req, "/", http.StatusFound)
 				return
 			}
 		}
 		randState := randState()
-		authURL := ss.config.AuthCodeURL(randState)
-		token := SessionToken(randState)
-		ss.sessions[token] = nil
+		if randState == "" {
+			http.Error(rw, "Unable to start login", http.StatusInternalServerError)
+			return
+		}
+		// Offline access with consent gives a refresh token on every login
+		authURL := ss.config.AuthCodeURL(randState, oauth2.AccessTypeOffline, oauth2.ApprovalForce)
+		ss.pending.Add(SessionToken(randState))
+		// The state is only accepted back from the browser that got it
+		ss.setCookie(rw, loginStateCookie, randState, loginStateLifetime)
 		http.Redirect(rw, req, authURL, http.StatusFound)
-		fmt.Println("Redirecting to", authURL)
+		logger.Println("Redirecting to", authURL)
 	}
 
 }
@@ -73,62 +234,95 @@ func loginUser(ss ServerState) func(rw http.ResponseWriter, req *http.Request) {
 func authCallback(ss ServerState) func(rw http.ResponseWriter, req *http.Request) {
 	return func(rw http.ResponseWriter, req *http.Request) {
 		query := req.URL.Query()
-		username := query.Get("state")
+		state := query.Get("state")
 		authCode := query.Get("code")
-		if username == "" || authCode == "" {
-			http.Error(rw, "No username or auth code given", http.StatusBadRequest)
-			fmt.Println("No username or auth code given")
+		if state == "" || authCode == "" {
+			http.Error(rw, "No state or auth code given", http.StatusBadRequest)
+			logger.Println("No state or auth code given")
 			return
 		}
-		token := SessionToken(username)
-		svc, ok := ss.sessions[token]
 
-		if !ok {
-			// CSRF state mismatch
+		stateCookie, err := req.Cookie(loginStateCookie)
+		ss.clearCookie(rw, loginStateCookie)
+		if err != nil || stateCookie.Value != state || !ss.pending.Take(SessionToken(state)) {
+			// CSRF state mismatch or the login took too long
 			http.Error(rw, "Invalid state", http.StatusBadRequest)
-			fmt.Println("Invalid state")
+			logger.Println("Invalid state")
 			return
 		}
 
-		if svc != nil {
-			fmt.Println("Session already exists for user", username)
-			http.Redirect(rw, req, "/", http.StatusFound)
+		oauthToken, err := ss.config.Exchange(ss.ctx, authCode)
+		if err != nil {
+			http.Error(rw, "Unable to exchange auth code", http.StatusInternalServerError)
+			logger.Println("Unable to exchange auth code for token", err)
 			return
 		}
-
-		// Place the auth code into the cookie for the user
-		cookie := &http.Cookie{
-			Name:     "authCodeEvPlanner",
-			Value:    username,
-			Domain:   "horned.xyz",
-			Expires:  time.Now().Add(24 * time.Hour),
-			HttpOnly: false,
-			Secure:   true,
-			SameSite: http.SameSiteLaxMode,
+		// A fresh id is used for the session, the state has been seen in urls
+		id, err := newSessionID()
+		if err != nil {
+			http.Error(rw, "Unable to create session", http.StatusInternalServerError)
+			logger.Println("Unable to create session id", err)
+			return
+		}
+		// Uploads and other things kept on the server belong to the account
+		var user string
+		if svc, err := newCalendarService(ss.ctx, ss.config.TokenSource(ss.ctx, oauthToken)); err == nil {
+			user, err = NewGoogleSource(svc, 0, 0).AccountID(req.Context())
+			if err != nil {
+				logger.Println("Unable to read the account of the user", err)
+			}
 		}
-		http.SetCookie(rw, cookie)
-		service := getService(ss.ctx, ss.config, authCode)
-		if service == nil {
-			http.Error(rw, "Unable to create calendar service", http.StatusInternalServerError)
-			fmt.Println("Unable to create calendar service")
+		now := time.Now()
+		err = ss.sessions.Put(id, &Session{Token: oauthToken, User: user, Created: now, Expires: now.Add(sessionLifetime)})
+		if err != nil {
+			http.Error(rw, "Unable to save session", http.StatusInternalServerError)
+			logger.Println("Unable to save session", err)
 			return
 		}
-		ss.sessions[token] = service
-		fmt.Println("User", username, "has been authorized")
+
+		ss.setCookie(rw, sessionCookie, ss.signer.Sign(id), sessionLifetime)
+		logger.Println("User has been authorized")
 		http.Redirect(rw, req, "/", http.StatusFound)
 	}
 }
 
-func staticFileServer() http.Handler {
-	return http.FileServer(http.Dir("./dist"))
+func staticFileServer(dir string) http.Handler {
+	return http.FileServer(http.Dir(dir))
 }
 
 type Query struct {
 	NumDays  int
 	EventLoc string
 	StartLoc string
+	// Length of the event, given in minutes in the request body
 	Duration time.Duration
 	CalIds   []string
+	// Optional, the server's working hours are used if not given
+	WorkingHours WorkingHours
+	// Treat tentative events as free instead of busy
+	TentativeFree bool
+	// Ignore all day events instead of blocking their days
+	IgnoreAllDay bool
+	// IANA name of the zone the working hours are in, the server's default if empty
+	TimeZone string
+	// Whether calendars are read as free/busy only, "always" or "never".
+	// By default only the calendars whose events cannot be listed are
+	FreeBusy FreeBusyMode
+	// Optional, how much each part of the score counts
+	Weights *ScoreWeights
+	// Optional, the preferred start of the event as HH:MM
+	PreferredTime string
+	// Minutes between the candidate starts within a free window, whole
+	// windows are returned if zero
+	GranularityMinutes int
+	// Most slots returned for a day, all if zero
+	MaxPerDay int
+	// Rate candidates right before or after an event higher
+	PreferAdjacent bool
+	// Minutes kept free before and after every event, on top of the
+	// buffers of the server's config
+	BufferBeforeMinutes int
+	BufferAfterMinutes  int
 }
 
 // Marshal the query into a json string
@@ -152,6 +346,15 @@ func (q *Query) Unmarshal(s string) error {
 }
 
 func (q *Query) validate() error {
+	if len(q.CalIds) == 0 {
+		return fmt.Errorf("no calendars given")
+	}
+	return q.validateSearch()
+}
+
+// validateSearch checks everything but the calendars, which group
+// queries take from their participants
+func (q *Query) validateSearch() error {
 	if q.NumDays <= 0 {
 		return fmt.Errorf("invalid number of days")
 	}
@@ -164,34 +367,70 @@ func (q *Query) validate() error {
 	if q.Duration <= 0 {
 		return fmt.Errorf("invalid duration")
 	}
-	if len(q.CalIds) == 0 {
-		return fmt.Errorf("no calendars given")
+	if err := q.WorkingHours.validate(); err != nil {
+		return fmt.Errorf("invalid working hours: %w", err)
 	}
-	return nil
+	if _, err := loadLocation(q.TimeZone); err != nil {
+		return fmt.Errorf("invalid time zone: %w", err)
+	}
+	if q.Weights != nil {
+		if err := q.Weights.validate(); err != nil {
+			return fmt.Errorf("invalid weights: %w", err)
+		}
+	}
+	if _, err := q.preferredTime(); err != nil {
+		return fmt.Errorf("invalid preferred time: %w", err)
+	}
+	if q.GranularityMinutes < 0 || q.GranularityMinutes > 24*60 {
+		return fmt.Errorf("invalid granularity, use up to a day of minutes")
+	}
+	if q.MaxPerDay < 0 {
+		return fmt.Errorf("invalid maximum of slots per day")
+	}
+	if err := q.buffers().validate(); err != nil {
+		return err
+	}
+	return q.FreeBusy.validate()
+}
+
+// buffers are the buffers the query keeps around every event
+func (q *Query) buffers() Buffers {
+	return Buffers{Before: q.BufferBeforeMinutes, After: q.BufferAfterMinutes}
+}
+
+// scoreWeights are the weights of the query or else the default ones
+func (q *Query) scoreWeights() ScoreWeights {
+	if q.Weights == nil {
+		return DefaultScoreWeights()
+	}
+	return *q.Weights
+}
+
+// preferredTime is nil when no time is preferred
+func (q *Query) preferredTime() (*ClockTime, error) {
+	if q.PreferredTime == "" {
+		return nil, nil
+	}
+	t, err := parseClockTime(q.PreferredTime)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
 }
 
 func queryAvailableSlots(ss ServerState) func(rw http.ResponseWriter, req *http.Request) {
 	return func(rw http.ResponseWriter, req *http.Request) {
-		cookie, err := req.Cookie("authCodeEvPlanner")
-		if err != nil {
-			// http.Error(rw, "No auth code found", http.StatusUnauthorized)
-			fmt.Println("No auth code found")
+		token, ok := ss.sessionID(req)
+		if !ok {
+			logger.Println("No valid session cookie found")
 			http.Redirect(rw, req, "/login", http.StatusUnauthorized)
 			return
 		}
-		authCode := cookie.Value
-		if authCode == "" {
-			fmt.Println("Auth code is empty")
-			http.Error(rw, "No auth code found", http.StatusUnauthorized)
-			return
-		}
-		token := SessionToken(authCode)
-		calendarService, ok := ss.sessions[token]
+		source, ok := ss.sourceFor(token)
 		if !ok {
 			// Remove the cookie if the session is not found
-			fmt.Println("No Session found")
-			cookie.Expires = time.Now().Add(-1 * time.Hour)
-			http.SetCookie(rw, cookie)
+			logger.Println("No Session found")
+			ss.clearCookie(rw, sessionCookie)
 			http.Redirect(rw, req, "/login", http.StatusUnauthorized)
 			return
 		}
@@ -201,40 +440,53 @@ func queryAvailableSlots(ss ServerState) func(rw http.ResponseWriter, req *http.
 		// Read the body into a string and parse it into a Query struct
 		decoder := json.NewDecoder(body)
 		query := Query{}
-		err = decoder.Decode(&query)
+		err := decoder.Decode(&query)
 		if err != nil {
-			http.Error(rw, "Please provide the query in the body of the request in the following format: {\"NumDays\": 5, \"EventLoc\": \"New York\", \"StartLoc\": \"San Francisco\", \"Duration\": 2, \"CalIds\": [\"calendar1\", \"calendar2\"]}\n", http.StatusBadRequest)
-			fmt.Println("Unable to decode query")
+			http.Error(rw, "Please provide the query in the body of the request in the following format: {\"NumDays\": 5, \"EventLoc\": \"New York\", \"StartLoc\": \"San Francisco\", \"Duration\": 60, \"CalIds\": [\"calendar1\", \"calendar2\"]}\n", http.StatusBadRequest)
+			logger.Println("Unable to decode query")
 			return
 		}
+		// The duration is in minutes, like in the client and in Query.Unmarshal
+		query.Duration *= time.Minute
 
 		err = query.validate()
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusBadRequest)
-			fmt.Println("Invalid query", err)
+			logger.Println("Invalid query", err)
+			return
+		}
+		format, err := slotFormat(req)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusNotAcceptable)
+			return
+		}
+		opts, err := ss.slotOpts(source, query)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
 			return
 		}
 
 		// Get the list of available spots
-		availableSpots, err := findSlots(Opts{
-			numDays:         query.NumDays,
-			eventLoc:        query.EventLoc,
-			startLoc:        query.StartLoc,
-			duration:        query.Duration,
-			ctx:             ss.ctx,
-			calendarService: calendarService,
-			mapService:      ss.mapSvc,
-			ids:             query.CalIds,
-		})
+		results, err := findSlots(opts)
 
 		if err != nil {
 			http.Error(rw, "Unable to find available spots: "+err.Error(), http.StatusInternalServerError)
-			fmt.Println("Unable to find available spots", err)
+			logger.Println("Unable to find available spots", err)
+			return
+		}
+
+		if len(results.Truncated) > 0 {
+			rw.Header().Set(truncatedHeader, strings.Join(results.Truncated, ","))
+		}
+
+		rw.Header().Add("Vary", "Accept")
+		if format != formatJSON {
+			writeExport(rw, format, results.Slots, query.EventLoc, opts.loc)
 			return
 		}
 
 		// Send the available spots back to the user as json
-		b, err := json.Marshal(availableSpots)
+		b, err := json.Marshal(results)
 		if err != nil {
 			http.Error(rw, "Unable to marshal available spots", http.StatusInternalServerError)
 			return
@@ -244,36 +496,76 @@ func queryAvailableSlots(ss ServerState) func(rw http.ResponseWriter, req *http.
 	}
 }
 
+// slotOpts builds the search of a validated query, filling in the
+// server's defaults
+func (ss ServerState) slotOpts(source EventSource, query Query) (Opts, error) {
+	return newSlotOpts(ss.ctx, source, ss.distSvc, ss.defaults, query)
+}
+
+// newSlotOpts fills in what the query leaves out from the config, it is
+// shared by the server and the command line tools
+func newSlotOpts(ctx context.Context, source EventSource, distances DistanceProvider, defaults *Config, query Query) (Opts, error) {
+	hours := query.WorkingHours
+	if len(hours) == 0 {
+		hours = defaults.WorkingHours
+	}
+	loc, err := loadLocation(firstNonEmpty(query.TimeZone, defaults.TimeZone))
+	if err != nil {
+		return Opts{}, fmt.Errorf("invalid time zone: %w", err)
+	}
+	prefer, err := query.preferredTime()
+	if err != nil {
+		return Opts{}, fmt.Errorf("invalid preferred time: %w", err)
+	}
+	return Opts{
+		numDays:   query.NumDays,
+		eventLoc:  query.EventLoc,
+		startLoc:  query.StartLoc,
+		duration:  query.Duration,
+		ctx:       ctx,
+		source:    source,
+		distances: distances,
+		ids:       query.CalIds,
+		hours:     hours,
+		busy:      BusyOptions{TentativeFree: query.TentativeFree, IgnoreAllDay: query.IgnoreAllDay},
+		loc:       loc,
+		freeBusy:  query.FreeBusy,
+		weights:   query.scoreWeights(),
+		prefer:    prefer,
+
+		granularity:    time.Duration(query.GranularityMinutes) * time.Minute,
+		perDay:         query.MaxPerDay,
+		preferAdjacent: query.PreferAdjacent,
+		buffers:        defaults.Buffers.with(query.buffers()),
+	}, nil
+}
+
 func listCalendars(ss ServerState) func(rw http.ResponseWriter, req *http.Request) {
 	return func(rw http.ResponseWriter, req *http.Request) {
-		cookie, err := req.Cookie("authCodeEvPlanner")
-		if err != nil {
-			// http.Error(rw, "No auth code found", http.StatusUnauthorized)
+		token, ok := ss.sessionID(req)
+		if !ok {
 			http.Redirect(rw, req, "/login", http.StatusUnauthorized)
 			return
 		}
-		authCode := cookie.Value
-		if authCode == "" {
-			http.Error(rw, "No auth code value", http.StatusUnauthorized)
-			return
-		}
-		token := SessionToken(authCode)
-		calendarService, ok := ss.sessions[token]
+		source, ok := ss.sourceFor(token)
 		if !ok {
 			http.Error(rw, "No session found", http.StatusUnauthorized)
 			return
 		}
 
 		// TODO Make some caching mechanism to not list the calendars every time
-		cals, err := calendarService.CalendarList.List().Do()
+		cals, truncated, err := source.ListCalendars(req.Context())
 		if err != nil {
 			http.Error(rw, "Unable to list calendars", http.StatusInternalServerError)
-			fmt.Println("Unable to list calendars", err)
+			logger.Println("Unable to list calendars", err)
 			return
 		}
+		if truncated {
+			rw.Header().Set(truncatedHeader, "true")
+		}
 		// Send a json array of the calendar names
 		calendarNames := make(map[string]string, 0)
-		for _, cal := range cals.Items {
+		for _, cal := range cals {
 			calendarNames[cal.Summary] = cal.Id
 		}
 		b, err := json.Marshal(calendarNames)
@@ -286,3 +578,21 @@ func listCalendars(ss ServerState) func(rw http.ResponseWriter, req *http.Reques
 		rw.Write(b)
 	}
 }
+
+func cacheStats(ss ServerState) func(rw http.ResponseWriter, req *http.Request) {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if _, _, ok := ss.userSource(rw, req); !ok {
+			return
+		}
+		b, err := json.Marshal(map[string]*CacheCounter{
+			"distances": &ss.cache.Distances,
+			"geocodes":  &ss.cache.Geocodes,
+		})
+		if err != nil {
+			http.Error(rw, "Unable to marshal cache stats", http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write(b)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	sessionBucket = "sessions"
+	// Holds the signed session id
+	sessionCookie = "authCodeEvPlanner"
+	// Binds the OAuth state to the browser that started the login
+	loginStateCookie = "oauthStateEvPlanner"
+	// How long a session and its cookie last
+	sessionLifetime = 24 * time.Hour
+	// How long a login can take before its state is forgotten
+	loginStateLifetime = 5 * time.Minute
+)
+
+// Session is a logged in user
+type Session struct {
+	Token *oauth2.Token
+	// Account of the user, owns what the user keeps on the server
+	User    string
+	Created time.Time
+	Expires time.Time
+}
+
+func (s *Session) expired(now time.Time) bool {
+	return !s.Expires.IsZero() && !now.Before(s.Expires)
+}
+
+// SessionStore keeps the sessions of logged in users, all methods
+// are safe for concurrent use
+type SessionStore interface {
+	// Get loads the session, found is false if there is none or it expired
+	Get(id SessionToken) (session *Session, found bool, err error)
+	Put(id SessionToken, session *Session) error
+	Delete(id SessionToken) error
+	// DeleteExpired removes the sessions that expired before now
+	DeleteExpired(now time.Time) (int, error)
+}
+
+// MemorySessionStore keeps sessions until the server stops
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[SessionToken]Session
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[SessionToken]Session)}
+}
+
+func (m *MemorySessionStore) Get(id SessionToken) (*Session, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok || s.expired(time.Now()) {
+		return nil, false, nil
+	}
+	return &s, true, nil
+}
+
+func (m *MemorySessionStore) Put(id SessionToken, session *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[id] = *session
+	return nil
+}
+
+func (m *MemorySessionStore) Delete(id SessionToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *MemorySessionStore) DeleteExpired(now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	removed := 0
+	for id, s := range m.sessions {
+		if s.expired(now) {
+			delete(m.sessions, id)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// DBSessionStore keeps sessions in the database, encrypted with the server key.
+// Sessions are stored under a hash of their id so the database does not
+// hold usable session ids
+type DBSessionStore struct {
+	store *Store
+	aead  cipher.AEAD
+}
+
+// NewDBSessionStore creates the store with a 32 byte AES-256 key
+func NewDBSessionStore(store *Store, key []byte) (*DBSessionStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &DBSessionStore{store: store, aead: aead}, nil
+}
+
+func sessionKey(id SessionToken) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *DBSessionStore) Get(id SessionToken) (*Session, bool, error) {
+	key := sessionKey(id)
+	sealed, found, err := d.store.Get(sessionBucket, key)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	session, err := d.open(key, sealed)
+	if err != nil {
+		return nil, false, err
+	}
+	if session.expired(time.Now()) {
+		return nil, false, nil
+	}
+	return session, true, nil
+}
+
+// seal encrypts plain with the server key, the key is the additional data
+// so that sealed values cannot be swapped
+func (d *DBSessionStore) seal(key string, plain []byte) ([]byte, error) {
+	nonce := make([]byte, d.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return d.aead.Seal(nonce, nonce, plain, []byte(key)), nil
+}
+
+// unseal decrypts what seal encrypted under the same key
+func (d *DBSessionStore) unseal(key string, sealed []byte) ([]byte, error) {
+	n := d.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, fmt.Errorf("sealed value is too short")
+	}
+	return d.aead.Open(nil, sealed[:n], sealed[n:], []byte(key))
+}
+
+func (d *DBSessionStore) open(key string, sealed []byte) (*Session, error) {
+	plain, err := d.unseal(key, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt session: %w", err)
+	}
+	session := &Session{}
+	if err := json.Unmarshal(plain, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (d *DBSessionStore) Put(id SessionToken, session *Session) error {
+	key := sessionKey(id)
+	plain, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	sealed, err := d.seal(key, plain)
+	if err != nil {
+		return err
+	}
+	return d.store.Put(sessionBucket, key, sealed)
+}
+
+func (d *DBSessionStore) Delete(id SessionToken) error {
+	return d.store.Delete(sessionBucket, sessionKey(id))
+}
+
+// DeleteExpired also removes the sessions that can no longer be
+// decrypted, such as the ones written with an older server key
+func (d *DBSessionStore) DeleteExpired(now time.Time) (int, error) {
+	var stale []string
+	err := d.store.ForEach(sessionBucket, func(key string, sealed []byte) error {
+		session, err := d.open(key, sealed)
+		if err != nil || session.expired(now) {
+			stale = append(stale, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range stale {
+		if err := d.store.Delete(sessionBucket, key); err != nil {
+			return 0, err
+		}
+	}
+	return len(stale), nil
+}
+
+// parseServerKey decodes the base64 encoded 32 byte server key,
+// an empty key gives a nil key
+func parseServerKey(encodedKey string) ([]byte, error) {
+	if encodedKey == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("session key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// createSessionStore stores sessions in the database when a server key
+// is given, and in memory otherwise
+func createSessionStore(store *Store, key []byte) (SessionStore, error) {
+	if key == nil {
+		logger.Println("No SESSION_KEY set, sessions will not survive a restart")
+		return NewMemorySessionStore(), nil
+	}
+	return NewDBSessionStore(store, key)
+}
+
+// CookieSigner signs session ids with HMAC-SHA256 so that session
+// cookies cannot be forged
+type CookieSigner struct {
+	key []byte
+}
+
+// NewCookieSigner derives the signing key from the server key, without a
+// server key a random one is used and cookies only last until a restart
+func NewCookieSigner(serverKey []byte) (*CookieSigner, error) {
+	if serverKey == nil {
+		serverKey = make([]byte, 32)
+		if _, err := rand.Read(serverKey); err != nil {
+			return nil, err
+		}
+	}
+	// Separate from the encryption key, which is the server key itself
+	mac := hmac.New(sha256.New, serverKey)
+	mac.Write([]byte("session cookie"))
+	return &CookieSigner{key: mac.Sum(nil)}, nil
+}
+
+func (c *CookieSigner) mac(id SessionToken) []byte {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(id))
+	return mac.Sum(nil)
+}
+
+// Sign returns the cookie value for the session id
+func (c *CookieSigner) Sign(id SessionToken) string {
+	return string(id) + "." + base64.RawURLEncoding.EncodeToString(c.mac(id))
+}
+
+// Verify returns the session id of a signed cookie value
+func (c *CookieSigner) Verify(value string) (SessionToken, bool) {
+	id, sig, found := strings.Cut(value, ".")
+	if !found || id == "" {
+		return "", false
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, c.mac(SessionToken(id))) {
+		return "", false
+	}
+	return SessionToken(id), true
+}
+
+// newSessionID creates a random session id
+func newSessionID() (SessionToken, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return SessionToken(base64.RawURLEncoding.EncodeToString(b)), nil
+}
+
+// savingTokenSource saves refreshed tokens back into the session store
+type savingTokenSource struct {
+	base    oauth2.TokenSource
+	store   SessionStore
+	id      SessionToken
+	session Session
+	mu      sync.Mutex
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.base.Token()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.session.Token == nil || tok.AccessToken != s.session.Token.AccessToken {
+		s.session.Token = tok
+		if err := s.store.Put(s.id, &s.session); err != nil {
+			logger.Println("Unable to save refreshed token", err)
+		}
+	}
+	return tok, nil
+}
+
+// sessionTokenSource refreshes the token of the session when it expires
+func sessionTokenSource(ctx context.Context, config *oauth2.Config, store SessionStore, id SessionToken, session *Session) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(session.Token, &savingTokenSource{
+		base:    config.TokenSource(ctx, session.Token),
+		store:   store,
+		id:      id,
+		session: *session,
+	})
+}
+
+// LoginStates remembers the OAuth states of logins in progress
+type LoginStates struct {
+	mu     sync.Mutex
+	states map[SessionToken]time.Time
+}
+
+func NewLoginStates() *LoginStates {
+	return &LoginStates{states: make(map[SessionToken]time.Time)}
+}
+
+func (l *LoginStates) Add(state SessionToken) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.states[state] = time.Now().Add(loginStateLifetime)
+}
+
+// Take removes the state, reporting whether it was pending and not expired
+func (l *LoginStates) Take(state SessionToken) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	expires, ok := l.states[state]
+	delete(l.states, state)
+	return ok && time.Now().Before(expires)
+}
+
+func (l *LoginStates) DeleteExpired(now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	removed := 0
+	for state, expires := range l.states {
+		if !now.Before(expires) {
+			delete(l.states, state)
+			removed++
+		}
+	}
+	return removed
+}
+
+// startSweeper removes expired sessions, login states and cache entries
+// every interval until the returned stop function is called, stop waits
+// for the sweeper
+func startSweeper(sessions SessionStore, logins *LoginStates, cache *Cache, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				removed, err := sessions.DeleteExpired(now)
+				if err != nil {
+					logger.Println("Unable to remove expired sessions", err)
+				}
+				removed += logins.DeleteExpired(now)
+				if removed > 0 {
+					logger.Println("Removed", removed, "expired sessions and login states")
+				}
+				cached, err := cache.DeleteExpired(now)
+				if err != nil {
+					logger.Println("Unable to remove expired cache entries", err)
+				}
+				if cached > 0 {
+					logger.Println("Removed", cached, "expired cache entries")
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-finished
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func testStore(t *testing.T) *Store {
+	store, err := OpenStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestSessionStores(t *testing.T) {
+	db, err := NewDBSessionStore(testStore(t), bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]SessionStore{"memory": NewMemorySessionStore(), "database": db}
+	now := time.Now().Truncate(time.Second)
+	session := &Session{
+		Token:   &oauth2.Token{AccessToken: "access-secret", RefreshToken: "refresh-secret", TokenType: "Bearer", Expiry: now.Add(time.Hour)},
+		User:    "alice@example.com",
+		Created: now,
+		Expires: now.Add(sessionLifetime),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			if err := store.Put("alive", session); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Put("expired", &Session{User: "bob@example.com", Expires: now.Add(-time.Minute)}); err != nil {
+				t.Fatal(err)
+			}
+			got, found, err := store.Get("alive")
+			if err != nil || !found {
+				t.Fatalf("found %v, %v", found, err)
+			}
+			if got.User != session.User || !got.Created.Equal(session.Created) || !got.Expires.Equal(session.Expires) ||
+				got.Token.AccessToken != "access-secret" || got.Token.RefreshToken != "refresh-secret" || !got.Token.Expiry.Equal(session.Token.Expiry) {
+				t.Errorf("read back %+v, token %+v", got, got.Token)
+			}
+			for _, id := range []SessionToken{"expired", "unknown"} {
+				if _, found, err := store.Get(id); found || err != nil {
+					t.Errorf("%v session found %v, %v", id, found, err)
+				}
+			}
+			if removed, err := store.DeleteExpired(now); removed != 1 || err != nil {
+				t.Errorf("removed %d sessions, %v", removed, err)
+			}
+			if err := store.Delete("alive"); err != nil {
+				t.Fatal(err)
+			}
+			if _, found, _ := store.Get("alive"); found {
+				t.Error("deleted session found")
+			}
+		})
+	}
+}
+
+func TestDBSessionStoreEncrypts(t *testing.T) {
+	store := testStore(t)
+	sessions, err := NewDBSessionStore(store, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := &Session{Token: &oauth2.Token{AccessToken: "access-secret"}, User: "alice@example.com", Expires: time.Now().Add(time.Hour)}
+	for _, id := range []SessionToken{"first-id", "second-id"} {
+		if err := sessions.Put(id, session); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = store.ForEach(sessionBucket, func(key string, sealed []byte) error {
+		for _, secret := range []string{"first-id", "second-id", "access-secret", "alice@example.com"} {
+			if bytes.Contains([]byte(key), []byte(secret)) || bytes.Contains(sealed, []byte(secret)) {
+				t.Errorf("%q is stored in plain text", secret)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A sealed session only opens under the id it was written for
+	first, _, _ := store.Get(sessionBucket, sessionKey("first-id"))
+	if err := store.Put(sessionBucket, sessionKey("second-id"), first); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := sessions.Get("second-id"); found || err == nil {
+		t.Errorf("swapped session opened, found %v, %v", found, err)
+	}
+
+	// Sessions of an older key can no longer be read and get swept
+	rotated, err := NewDBSessionStore(store, bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := rotated.Get("first-id"); found || err == nil {
+		t.Errorf("opened with another key, found %v, %v", found, err)
+	}
+	if removed, err := rotated.DeleteExpired(time.Now()); removed != 2 || err != nil {
+		t.Errorf("removed %d sessions, %v", removed, err)
+	}
+}
+
+func TestParseServerKey(t *testing.T) {
+	tests := []struct {
+		encoded string
+		length  int
+		fails   bool
+	}{
+		{"", 0, false},
+		{"AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=", 32, false},
+		{"AQEBAQ==", 0, true},
+		{"not base64!", 0, true},
+	}
+	for _, test := range tests {
+		key, err := parseServerKey(test.encoded)
+		if (err != nil) != test.fails || len(key) != test.length {
+			t.Errorf("%q: %d bytes, %v", test.encoded, len(key), err)
+		}
+	}
+}
+
+func TestCookieSigner(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	signer, err := NewCookieSigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted, _ := NewCookieSigner(key)
+	other, _ := NewCookieSigner(bytes.Repeat([]byte{2}, 32))
+	random, _ := NewCookieSigner(nil)
+	value := signer.Sign("session-id")
+	id, sig, _ := strings.Cut(value, ".")
+	tests := []struct {
+		name   string
+		signer *CookieSigner
+		value  string
+		valid  bool
+	}{
+		{"signed", signer, value, true},
+		{"after a restart", restarted, value, true},
+		{"other server key", other, value, false},
+		{"random key", random, value, false},
+		{"changed id", signer, "session-ie." + sig, false},
+		{"changed signature", signer, id + "." + strings.ToUpper(sig), false},
+		{"signature of another id", signer, "other." + sig, false},
+		{"unsigned", signer, "session-id", false},
+		{"no id", signer, "." + sig, false},
+		{"signature not base64", signer, id + ".!!", false},
+		{"empty", signer, "", false},
+	}
+	for _, test := range tests {
+		got, ok := test.signer.Verify(test.value)
+		if ok != test.valid || (ok && got != "session-id") {
+			t.Errorf("%v: got %q, %v", test.name, got, ok)
+		}
+	}
+	if bytes.Equal(signer.key, key) {
+		t.Error("cookies are signed with the encryption key")
+	}
+}
+
+func TestLoginStates(t *testing.T) {
+	states := NewLoginStates()
+	states.Add("state")
+	states.Add("old")
+	states.states["old"] = time.Now().Add(-time.Second)
+	if states.Take("unknown") {
+		t.Error("took an unknown state")
+	}
+	if states.Take("old") {
+		t.Error("took an expired state")
+	}
+	if !states.Take("state") {
+		t.Error("unable to take the state")
+	}
+	if states.Take("state") {
+		t.Error("took the state twice")
+	}
+
+	states.Add("late")
+	states.Add("fresh")
+	if removed := states.DeleteExpired(time.Now().Add(loginStateLifetime / 2)); removed != 0 {
+		t.Errorf("removed %d pending states", removed)
+	}
+	if removed := states.DeleteExpired(time.Now().Add(loginStateLifetime)); removed != 2 {
+		t.Errorf("removed %d expired states, want 2", removed)
+	}
+}
+
+func TestAuthCallbackChecksState(t *testing.T) {
+	tests := []struct {
+		name          string
+		query, cookie string
+		pending       bool
+		clears        bool
+	}{
+		{"no state", "code=abc", "state", true, false},
+		{"no cookie", "state=state&code=abc", "", true, true},
+		{"cookie of another login", "state=state&code=abc", "other", true, true},
+		{"not pending", "state=state&code=abc", "state", false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ss := ServerState{pending: NewLoginStates(), defaults: &Config{}}
+			if test.pending {
+				ss.pending.Add("state")
+			}
+			req := httptest.NewRequest("GET", "/auth/callback?"+test.query, nil)
+			if test.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: loginStateCookie, Value: test.cookie})
+			}
+			rw := httptest.NewRecorder()
+			// Without an OAuth config, reaching the exchange would panic
+			authCallback(ss)(rw, req)
+			if rw.Code != http.StatusBadRequest {
+				t.Errorf("answered %v", rw.Code)
+			}
+			cleared := false
+			for _, c := range rw.Result().Cookies() {
+				cleared = cleared || c.Name == loginStateCookie && c.MaxAge < 0
+			}
+			if cleared != test.clears {
+				t.Errorf("cleared the state cookie %v", cleared)
+			}
+		})
+	}
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// EventSource is a backend that calendars and their events can be read from
+// The truncated result of the list methods reports whether the source
+// stopped before reaching the end of the results
+type EventSource interface {
+	// ListCalendars lists the calendars that are visible to the user
+	ListCalendars(ctx context.Context) (cals []*calendar.CalendarListEntry, truncated bool, err error)
+	// ListEvents lists the events of a calendar that overlap the window,
+	// recurring events are expanded into single instances
+	ListEvents(ctx context.Context, calID string, timeMin, timeMax time.Time) (events []*calendar.Event, truncated bool, err error)
+}
+
+const (
+	defaultPageSize = 250
+	defaultMaxPages = 20
+)
+
+// GoogleSource reads calendars from the Google Calendar API
+type GoogleSource struct {
+	svc *calendar.Service
+	// Number of results requested per page
+	PageSize int64
+	// Maximum number of pages walked per list call
+	MaxPages int
+}
+
+// NewGoogleSource creates a source for the service, zero values for the
+// page size and page cap use the defaults
+func NewGoogleSource(svc *calendar.Service, pageSize int64, maxPages int) *GoogleSource {
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	if maxPages <= 0 {
+		maxPages = defaultMaxPages
+	}
+	return &GoogleSource{svc: svc, PageSize: pageSize, MaxPages: maxPages}
+}
+
+// AccountID identifies the user, it is the id of the primary calendar,
+// which is the address of the account
+func (g *GoogleSource) AccountID(ctx context.Context) (string, error) {
+	cal, err := g.svc.Calendars.Get("primary").Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	return cal.Id, nil
+}
+
+func (g *GoogleSource) ListCalendars(ctx context.Context) ([]*calendar.CalendarListEntry, bool, error) {
+	var all []*calendar.CalendarListEntry
+	pageToken := ""
+	for page := 0; page < g.MaxPages; page++ {
+		call := g.svc.CalendarList.List().MaxResults(g.PageSize).Context(ctx)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		cals, err := call.Do()
+		if err != nil {
+			return nil, false, err
+		}
+		all = append(all, cals.Items...)
+		pageToken = cals.NextPageToken
+		if pageToken == "" {
+			return all, false, nil
+		}
+	}
+	logger.Printf("Calendar list truncated after %d pages\n", g.MaxPages)
+	return all, true, nil
+}
+
+func (g *GoogleSource) ListEvents(ctx context.Context, calID string, timeMin, timeMax time.Time) ([]*calendar.Event, bool, error) {
+	var all []*calendar.Event
+	pageToken := ""
+	for page := 0; page < g.MaxPages; page++ {
+		call := g.svc.Events.List(calID).
+			TimeMin(timeMin.Format(time.RFC3339)).
+			TimeMax(timeMax.Format(time.RFC3339)).
+			SingleEvents(true).
+			MaxResults(g.PageSize).
+			Context(ctx)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		events, err := call.Do()
+		if err != nil {
+			return nil, false, err
+		}
+		all = append(all, events.Items...)
+		pageToken = events.NextPageToken
+		if pageToken == "" {
+			return all, false, nil
+		}
+	}
+	logger.Printf("Events of %v truncated after %d pages\n", calID, g.MaxPages)
+	return all, true, nil
+}
+
+// MemorySource holds calendars in memory, useful for testing and for
+// backends that load all of their events up front
+type MemorySource struct {
+	Calendars []*calendar.CalendarListEntry
+	Events    map[string][]*calendar.Event
+	// Number of events created so far, their ids stay unique after deletes
+	created int
+}
+
+func NewMemorySource() *MemorySource {
+	return &MemorySource{Events: make(map[string][]*calendar.Event)}
+}
+
+// Add adds the events to the calendar, creating it if it does not exist
+func (m *MemorySource) Add(calID, summary string, events ...*calendar.Event) {
+	found := false
+	for _, c := range m.Calendars {
+		if c.Id == calID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		m.Calendars = append(m.Calendars, &calendar.CalendarListEntry{Id: calID, Summary: summary})
+	}
+	m.Events[calID] = append(m.Events[calID], events...)
+}
+
+func (m *MemorySource) ListCalendars(ctx context.Context) ([]*calendar.CalendarListEntry, bool, error) {
+	return m.Calendars, false, nil
+}
+
+func (m *MemorySource) ListEvents(ctx context.Context, calID string, timeMin, timeMax time.Time) ([]*calendar.Event, bool, error) {
+	all, ok := m.Events[calID]
+	if !ok {
+		return nil, false, fmt.Errorf("calendar %q not found", calID)
+	}
+	var events []*calendar.Event
+	for _, e := range all {
+		start, end, ok := eventTimes(e, timeMin.Location())
+		if !ok || !start.Before(timeMax) || !end.After(timeMin) {
+			continue
+		}
+		events = append(events, e)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return eventStartsBefore(events[i], events[j], timeMin.Location())
+	})
+	return events, false, nil
+}
+
+// How calendars whose events cannot be listed are read
+type FreeBusyMode string
+
+const (
+	// Use free/busy when the calendar API refuses to list the events
+	FreeBusyFallback FreeBusyMode = ""
+	// Only use free/busy, for calendars shared as free/busy only
+	FreeBusyAlways FreeBusyMode = "always"
+	FreeBusyNever  FreeBusyMode = "never"
+)
+
+func (m FreeBusyMode) validate() error {
+	switch m {
+	case FreeBusyFallback, FreeBusyAlways, FreeBusyNever:
+		return nil
+	}
+	return fmt.Errorf("unknown free/busy mode %q", m)
+}
+
+// Summary of the anonymous events made from busy intervals
+const busySummary = "busy"
+
+// FreeBusySource is implemented by sources that can report when calendars
+// are busy without showing their events
+type FreeBusySource interface {
+	// FreeBusy returns the busy intervals of each calendar within the window
+	FreeBusy(ctx context.Context, calIDs []string, timeMin, timeMax time.Time) (map[string][]*calendar.TimePeriod, error)
+}
+
+// The calendar API answers at most this many calendars per free/busy query
+const freeBusyMaxCalendars = 50
+
+func (g *GoogleSource) FreeBusy(ctx context.Context, calIDs []string, timeMin, timeMax time.Time) (map[string][]*calendar.TimePeriod, error) {
+	busy := make(map[string][]*calendar.TimePeriod)
+	for len(calIDs) > 0 {
+		chunk := calIDs[:min(len(calIDs), freeBusyMaxCalendars)]
+		calIDs = calIDs[len(chunk):]
+		req := &calendar.FreeBusyRequest{
+			TimeMin: timeMin.Format(time.RFC3339),
+			TimeMax: timeMax.Format(time.RFC3339),
+		}
+		for _, id := range chunk {
+			req.Items = append(req.Items, &calendar.FreeBusyRequestItem{Id: id})
+		}
+		resp, err := g.svc.Freebusy.Query(req).Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range chunk {
+			cal, ok := resp.Calendars[id]
+			if !ok {
+				return nil, fmt.Errorf("no free/busy returned for calendar %q", id)
+			}
+			if len(cal.Errors) > 0 {
+				return nil, fmt.Errorf("free/busy of calendar %q: %v", id, cal.Errors[0].Reason)
+			}
+			busy[id] = cal.Busy
+		}
+	}
+	return busy, nil
+}
+
+// isAccessError reports whether the calendar API refused to list a
+// calendar, which it does for calendars only shared as free/busy
+func isAccessError(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && (apiErr.Code == http.StatusForbidden || apiErr.Code == http.StatusNotFound)
+}
+
+func (m *MemorySource) FreeBusy(ctx context.Context, calIDs []string, timeMin, timeMax time.Time) (map[string][]*calendar.TimePeriod, error) {
+	return freeBusyFromEvents(ctx, m, calIDs, timeMin, timeMax)
+}
+
+// freeBusyFromEvents gives the busy intervals of sources that list all events
+func freeBusyFromEvents(ctx context.Context, source EventSource, calIDs []string, timeMin, timeMax time.Time) (map[string][]*calendar.TimePeriod, error) {
+	busy := make(map[string][]*calendar.TimePeriod)
+	for _, id := range calIDs {
+		events, _, err := source.ListEvents(ctx, id, timeMin, timeMax)
+		if err != nil {
+			return nil, err
+		}
+		busy[id] = []*calendar.TimePeriod{}
+		for _, e := range events {
+			start, end, ok := eventTimes(e, timeMin.Location())
+			if !ok || !(BusyOptions{}).isBusy(e) {
+				continue
+			}
+			busy[id] = append(busy[id], &calendar.TimePeriod{Start: start.Format(time.RFC3339), End: end.Format(time.RFC3339)})
+		}
+	}
+	return busy, nil
+}
+
+// busyEvents turns busy intervals into anonymous events that block them
+func busyEvents(periods []*calendar.TimePeriod) []*calendar.Event {
+	events := make([]*calendar.Event, 0, len(periods))
+	for _, p := range periods {
+		events = append(events, &calendar.Event{
+			Summary: busySummary,
+			Start:   &calendar.EventDateTime{DateTime: p.Start},
+			End:     &calendar.EventDateTime{DateTime: p.End},
+		})
+	}
+	return events
+}
+
+// EventWriter is implemented by sources that can change events
+type EventWriter interface {
+	// InsertEvent creates the event in the calendar and returns it as stored
+	InsertEvent(ctx context.Context, calID string, e *calendar.Event) (*calendar.Event, error)
+	// PatchEvent updates the fields of the event that are set in e
+	PatchEvent(ctx context.Context, calID, eventID string, e *calendar.Event) (*calendar.Event, error)
+	// DeleteEvent removes the event, an event that is already gone is not an error
+	DeleteEvent(ctx context.Context, calID, eventID string) error
+}
+
+// TaggedSource is implemented by sources that can find events by the
+// private extended properties they were given
+type TaggedSource interface {
+	// ListTagged returns the events of the calendar whose private property has the value
+	ListTagged(ctx context.Context, calID, property, value string) ([]*calendar.Event, error)
+}
+
+func (g *GoogleSource) ListTagged(ctx context.Context, calID, property, value string) ([]*calendar.Event, error) {
+	var all []*calendar.Event
+	pageToken := ""
+	for page := 0; page < g.MaxPages; page++ {
+		call := g.svc.Events.List(calID).
+			PrivateExtendedProperty(property + "=" + value).
+			MaxResults(g.PageSize).
+			Context(ctx)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		events, err := call.Do()
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, events.Items...)
+		pageToken = events.NextPageToken
+		if pageToken == "" {
+			break
+		}
+	}
+	return all, nil
+}
+
+func (m *MemorySource) ListTagged(ctx context.Context, calID, property, value string) ([]*calendar.Event, error) {
+	var tagged []*calendar.Event
+	for _, e := range m.Events[calID] {
+		if e.ExtendedProperties != nil && e.ExtendedProperties.Private[property] == value {
+			tagged = append(tagged, e)
+		}
+	}
+	return tagged, nil
+}
+
+func (m *MultiSource) ListTagged(ctx context.Context, calID, property, value string) ([]*calendar.Event, error) {
+	source, id := m.route(calID)
+	tagged, ok := source.(TaggedSource)
+	if !ok {
+		return nil, nil
+	}
+	return tagged.ListTagged(ctx, id, property, value)
+}
+
+func (g *GoogleSource) InsertEvent(ctx context.Context, calID string, e *calendar.Event) (*calendar.Event, error) {
+	// Attendees get invitations for the new event
+	return g.svc.Events.Insert(calID, e).SendUpdates("all").Context(ctx).Do()
+}
+
+func (g *GoogleSource) PatchEvent(ctx context.Context, calID, eventID string, e *calendar.Event) (*calendar.Event, error) {
+	return g.svc.Events.Patch(calID, eventID, e).SendUpdates("all").Context(ctx).Do()
+}
+
+func (g *GoogleSource) DeleteEvent(ctx context.Context, calID, eventID string) error {
+	err := g.svc.Events.Delete(calID, eventID).SendUpdates("all").Context(ctx).Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && (apiErr.Code == http.StatusNotFound || apiErr.Code == http.StatusGone) {
+		return nil
+	}
+	return err
+}
+
+func (m *MemorySource) InsertEvent(ctx context.Context, calID string, e *calendar.Event) (*calendar.Event, error) {
+	if _, ok := m.Events[calID]; !ok {
+		return nil, fmt.Errorf("calendar %q not found", calID)
+	}
+	created := *e
+	m.created++
+	created.Id = fmt.Sprintf("%s-%d", calID, m.created)
+	m.Events[calID] = append(m.Events[calID], &created)
+	return &created, nil
+}
+
+func (m *MemorySource) PatchEvent(ctx context.Context, calID, eventID string, e *calendar.Event) (*calendar.Event, error) {
+	for _, stored := range m.Events[calID] {
+		if stored.Id != eventID {
+			continue
+		}
+		if e.Summary != "" {
+			stored.Summary = e.Summary
+		}
+		if e.Description != "" {
+			stored.Description = e.Description
+		}
+		if e.Status != "" {
+			stored.Status = e.Status
+		}
+		if e.Attendees != nil {
+			stored.Attendees = e.Attendees
+		}
+		if e.ExtendedProperties != nil {
+			// Private properties are merged, like the calendar API does
+			props := &calendar.EventExtendedProperties{Private: make(map[string]string)}
+			if stored.ExtendedProperties != nil {
+				props.Shared = stored.ExtendedProperties.Shared
+				maps.Copy(props.Private, stored.ExtendedProperties.Private)
+			}
+			maps.Copy(props.Private, e.ExtendedProperties.Private)
+			stored.ExtendedProperties = props
+		}
+		patched := *stored
+		return &patched, nil
+	}
+	return nil, fmt.Errorf("event %q not found in calendar %q", eventID, calID)
+}
+
+func (m *MemorySource) DeleteEvent(ctx context.Context, calID, eventID string) error {
+	events := m.Events[calID]
+	for i, stored := range events {
+		if stored.Id == eventID {
+			m.Events[calID] = append(events[:i:i], events[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+// MultiSource reads the calendars whose ids start with a known prefix from
+// the source of that prefix, and all others from the default source
+type MultiSource struct {
+	Default EventSource
+	// Sources by prefix, their calendar ids are given without it
+	Prefixed map[string]EventSource
+}
+
+func (m *MultiSource) route(calID string) (EventSource, string) {
+	for prefix, source := range m.Prefixed {
+		if id, ok := strings.CutPrefix(calID, prefix); ok {
+			return source, id
+		}
+	}
+	return m.Default, calID
+}
+
+func (m *MultiSource) ListCalendars(ctx context.Context) ([]*calendar.CalendarListEntry, bool, error) {
+	all, truncated, err := m.Default.ListCalendars(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	prefixes := make([]string, 0, len(m.Prefixed))
+	for prefix := range m.Prefixed {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		cals, cut, err := m.Prefixed[prefix].ListCalendars(ctx)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, c := range cals {
+			entry := *c
+			entry.Id = prefix + c.Id
+			all = append(all, &entry)
+		}
+		truncated = truncated || cut
+	}
+	return all, truncated, nil
+}
+
+func (m *MultiSource) ListEvents(ctx context.Context, calID string, timeMin, timeMax time.Time) ([]*calendar.Event, bool, error) {
+	source, id := m.route(calID)
+	return source.ListEvents(ctx, id, timeMin, timeMax)
+}
+
+// FreeBusy sends one query to each source for all of its calendars
+func (m *MultiSource) FreeBusy(ctx context.Context, calIDs []string, timeMin, timeMax time.Time) (map[string][]*calendar.TimePeriod, error) {
+	var sources []FreeBusySource
+	ids := make(map[FreeBusySource][]string)
+	for _, calID := range calIDs {
+		source, _ := m.route(calID)
+		busySource, ok := source.(FreeBusySource)
+		if !ok {
+			return nil, fmt.Errorf("calendar %q has no free/busy information", calID)
+		}
+		if _, seen := ids[busySource]; !seen {
+			sources = append(sources, busySource)
+		}
+		ids[busySource] = append(ids[busySource], calID)
+	}
+
+	busy := make(map[string][]*calendar.TimePeriod)
+	for _, busySource := range sources {
+		routed := make([]string, len(ids[busySource]))
+		for i, calID := range ids[busySource] {
+			_, routed[i] = m.route(calID)
+		}
+		part, err := busySource.FreeBusy(ctx, routed, timeMin, timeMax)
+		if err != nil {
+			return nil, err
+		}
+		for i, calID := range ids[busySource] {
+			busy[calID] = part[routed[i]]
+		}
+	}
+	return busy, nil
+}
+
+func (m *MultiSource) writer(calID string) (EventWriter, string, error) {
+	source, id := m.route(calID)
+	writer, ok := source.(EventWriter)
+	if !ok {
+		return nil, "", fmt.Errorf("calendar %q is read only", calID)
+	}
+	return writer, id, nil
+}
+
+func (m *MultiSource) InsertEvent(ctx context.Context, calID string, e *calendar.Event) (*calendar.Event, error) {
+	writer, id, err := m.writer(calID)
+	if err != nil {
+		return nil, err
+	}
+	return writer.InsertEvent(ctx, id, e)
+}
+
+func (m *MultiSource) PatchEvent(ctx context.Context, calID, eventID string, e *calendar.Event) (*calendar.Event, error) {
+	writer, id, err := m.writer(calID)
+	if err != nil {
+		return nil, err
+	}
+	return writer.PatchEvent(ctx, id, eventID, e)
+}
+
+func (m *MultiSource) DeleteEvent(ctx context.Context, calID, eventID string) error {
+	writer, id, err := m.writer(calID)
+	if err != nil {
+		return err
+	}
+	return writer.DeleteEvent(ctx, id, eventID)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// failingSource fails to list the calendars in fails and counts the
+// free/busy queries
+type failingSource struct {
+	*MemorySource
+	fails   map[string]error
+	queries int
+	queried []string
+}
+
+func (f *failingSource) ListEvents(ctx context.Context, calID string, timeMin, timeMax time.Time) ([]*calendar.Event, bool, error) {
+	if err := f.fails[calID]; err != nil {
+		return nil, false, err
+	}
+	return f.MemorySource.ListEvents(ctx, calID, timeMin, timeMax)
+}
+
+func (f *failingSource) FreeBusy(ctx context.Context, calIDs []string, timeMin, timeMax time.Time) (map[string][]*calendar.TimePeriod, error) {
+	f.queries++
+	f.queried = append(f.queried, calIDs...)
+	return freeBusyFromEvents(ctx, f.MemorySource, calIDs, timeMin, timeMax)
+}
+
+func TestRetrieveEventsFallsBackOnAccessErrors(t *testing.T) {
+	now := time.Date(2030, 1, 7, 0, 0, 0, 0, time.UTC)
+	meeting := testEvent("Meeting", "", now.Add(9*time.Hour), now.Add(10*time.Hour))
+	tests := []struct {
+		name   string
+		err    error
+		events int
+		busy   bool
+		fails  bool
+	}{
+		{"listed", nil, 1, false, false},
+		{"forbidden", &googleapi.Error{Code: http.StatusForbidden}, 1, true, false},
+		{"not found", &googleapi.Error{Code: http.StatusNotFound}, 1, true, false},
+		{"server error", &googleapi.Error{Code: http.StatusInternalServerError}, 0, false, true},
+		{"canceled", context.Canceled, 0, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := &failingSource{MemorySource: NewMemorySource(), fails: map[string]error{"shared": test.err}}
+			src.Add("shared", "Shared", meeting)
+			src.Add("empty", "Empty")
+			events, _, err := retrieveEvents(context.Background(), now, 1, []string{"shared", "empty"}, src, FreeBusyFallback, BufferConfig{})
+			if (err != nil) != test.fails {
+				t.Fatalf("got %v", err)
+			}
+			if len(events) != test.events {
+				t.Fatalf("got %d events, want %d", len(events), test.events)
+			}
+			if test.busy != (len(events) > 0 && events[0].Summary == busySummary) {
+				t.Errorf("read %q with free/busy %v, want %v", events[0].Summary, !test.busy, test.busy)
+			}
+			if slices.Contains(src.queried, "empty") {
+				t.Error("an empty calendar was read with free/busy")
+			}
+		})
+	}
+}
+
+func TestMultiSourceBatchesFreeBusy(t *testing.T) {
+	google := &failingSource{MemorySource: NewMemorySource()}
+	other := &failingSource{MemorySource: NewMemorySource()}
+	for _, id := range []string{"a", "b", "c"} {
+		google.Add(id, id)
+		other.Add(id, id)
+	}
+	multi := &MultiSource{Default: google, Prefixed: map[string]EventSource{"other:": other}}
+	now := time.Date(2030, 1, 7, 0, 0, 0, 0, time.UTC)
+	busy, err := multi.FreeBusy(context.Background(), []string{"a", "other:a", "b", "c", "other:b"}, now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if google.queries != 1 || other.queries != 1 {
+		t.Errorf("sent %d and %d queries, want one per source", google.queries, other.queries)
+	}
+	if !slices.Equal(other.queried, []string{"a", "b"}) {
+		t.Errorf("queried %v without the prefix", other.queried)
+	}
+	if len(busy) != 5 {
+		t.Errorf("got the free/busy of %d calendars", len(busy))
+	}
+}
+
+func TestMemorySourceListEvents(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2030, 1, 7, hour, 0, 0, 0, time.UTC)
+	}
+	src := NewMemorySource()
+	src.Add("primary", "Primary",
+		testEvent("Late", "", at(15), at(16)),
+		testEvent("Early", "", at(8), at(10)),
+		testEvent("Noon", "", at(12), at(13)),
+	)
+	src.Add("primary", "Renamed", testEvent("Evening", "", at(19), at(20)))
+	src.Add("empty", "Empty")
+	tests := []struct {
+		name     string
+		calID    string
+		min, max time.Time
+		want     []string
+		fails    bool
+	}{
+		{"whole day", "primary", at(0), at(24), []string{"Early", "Noon", "Late", "Evening"}, false},
+		{"overlapping the edges", "primary", at(9), at(15), []string{"Early", "Noon"}, false},
+		{"touching is not overlapping", "primary", at(10), at(12), nil, false},
+		{"empty calendar", "empty", at(0), at(24), nil, false},
+		{"unknown calendar", "other", at(0), at(24), nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events, truncated, err := src.ListEvents(context.Background(), test.calID, test.min, test.max)
+			if (err != nil) != test.fails || truncated {
+				t.Fatalf("got %v, truncated %v", err, truncated)
+			}
+			var got []string
+			for _, e := range events {
+				got = append(got, e.Summary)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+	if cals, _, _ := src.ListCalendars(context.Background()); len(cals) != 2 || cals[0].Summary != "Primary" {
+		t.Errorf("calendars %v, adding to a calendar should not create it again", cals)
+	}
+}
+
+func TestMemorySourceWrites(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2030, 1, 7, 9, 0, 0, 0, time.UTC)
+	src := NewMemorySource()
+	src.Add("primary", "Primary")
+	var source EventSource = src
+	writer, ok := source.(EventWriter)
+	if !ok {
+		t.Fatal("MemorySource is not an EventWriter")
+	}
+
+	first, err := writer.InsertEvent(ctx, "primary", testEvent("First", "", start, start.Add(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.DeleteEvent(ctx, "primary", first.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.DeleteEvent(ctx, "primary", first.Id); err != nil {
+		t.Errorf("deleting a deleted event: %v", err)
+	}
+	second, err := writer.InsertEvent(ctx, "primary", &calendar.Event{
+		Summary:            "Second",
+		Start:              eventDateTime(start, time.UTC),
+		End:                eventDateTime(start.Add(time.Hour), time.UTC),
+		ExtendedProperties: &calendar.EventExtendedProperties{Private: map[string]string{"kept": "yes"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Id == first.Id {
+		t.Errorf("the id %v was given twice", second.Id)
+	}
+	if _, err := writer.InsertEvent(ctx, "other", &calendar.Event{}); err == nil {
+		t.Error("inserted into an unknown calendar")
+	}
+
+	patched, err := writer.PatchEvent(ctx, "primary", second.Id, &calendar.Event{
+		Status:             "confirmed",
+		ExtendedProperties: &calendar.EventExtendedProperties{Private: map[string]string{"added": "yes"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patched.Summary != "Second" || patched.Status != "confirmed" {
+		t.Errorf("patched to %q %q, unset fields should be kept", patched.Summary, patched.Status)
+	}
+	if props := patched.ExtendedProperties.Private; props["kept"] != "yes" || props["added"] != "yes" {
+		t.Errorf("private properties %v were not merged", props)
+	}
+	if _, err := writer.PatchEvent(ctx, "primary", first.Id, &calendar.Event{}); err == nil {
+		t.Error("patched a deleted event")
+	}
+}
+
+func TestMemorySourceFreeBusy(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2030, 1, 7, hour, 0, 0, 0, time.UTC)
+	}
+	free := testEvent("Free", "", at(9), at(10))
+	free.Transparency = "transparent"
+	cancelled := testEvent("Cancelled", "", at(10), at(11))
+	cancelled.Status = "cancelled"
+	src := NewMemorySource()
+	src.Add("primary", "Primary", free, cancelled, testEvent("Busy", "", at(11), at(12)))
+	src.Add("empty", "Empty")
+
+	busy, err := src.FreeBusy(context.Background(), []string{"primary", "empty"}, at(0), at(24))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(busy["primary"]) != 1 || busy["primary"][0].Start != at(11).Format(time.RFC3339) {
+		t.Errorf("busy %+v, only the busy event should block time", busy["primary"])
+	}
+	if periods, ok := busy["empty"]; !ok || len(periods) != 0 {
+		t.Errorf("empty calendar gave %v, %v", periods, ok)
+	}
+}
+
+func TestMultiSourceRoutes(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2030, 1, 7, 9, 0, 0, 0, time.UTC)
+	google, local := NewMemorySource(), NewMemorySource()
+	google.Add("primary", "Google", testEvent("Remote", "", start, start.Add(time.Hour)))
+	local.Add("work", "Work", testEvent("Local", "", start, start.Add(time.Hour)))
+	multi := &MultiSource{Default: google, Prefixed: map[string]EventSource{"ics:": local}}
+
+	cals, _, err := multi.ListCalendars(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, c := range cals {
+		ids = append(ids, c.Id)
+	}
+	if !slices.Equal(ids, []string{"primary", "ics:work"}) {
+		t.Errorf("listed %v", ids)
+	}
+	for calID, want := range map[string]string{"primary": "Remote", "ics:work": "Local"} {
+		events, _, err := multi.ListEvents(ctx, calID, start, start.Add(time.Hour))
+		if err != nil || len(events) != 1 || events[0].Summary != want {
+			t.Errorf("%v listed %v, %v", calID, events, err)
+		}
+	}
+	created, err := multi.InsertEvent(ctx, "ics:work", testEvent("New", "", start, start.Add(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(local.Events["work"]) != 2 || len(google.Events["primary"]) != 1 {
+		t.Errorf("inserted %v into the wrong source", created.Id)
+	}
+}
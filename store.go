@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Store is an embedded key value database on disk, split into buckets
+type Store struct {
+	db *bolt.DB
+}
+
+func OpenStore(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Get reads the value of the key, found is false if the key is not set
+func (s *Store) Get(bucket, key string) (value []byte, found bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(key)); v != nil {
+			// The slice is only valid during the transaction
+			value = append([]byte{}, v...)
+			found = true
+		}
+		return nil
+	})
+	return value, found, err
+}
+
+func (s *Store) Put(bucket, key string, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), value)
+	})
+}
+
+// PutAllJSON writes the values of the keys in one transaction
+func (s *Store) PutAllJSON(bucket string, values map[string]any) error {
+	encoded := make(map[string][]byte, len(values))
+	for key, v := range values {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		encoded[key] = b
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		for key, v := range encoded {
+			if err := b.Put([]byte(key), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Store) Delete(bucket, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// DeleteAll removes the keys in one transaction
+func (s *Store) DeleteAll(bucket string, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		for _, key := range keys {
+			if err := b.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ForEach calls f with every key of the bucket, f must not modify the store
+func (s *Store) ForEach(bucket string, f func(key string, value []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			return f(string(k), v)
+		})
+	})
+}
+
+// GetJSON decodes the value of the key into v
+func (s *Store) GetJSON(bucket, key string, v any) (bool, error) {
+	b, found, err := s.Get(bucket, key)
+	if err != nil || !found {
+		return false, err
+	}
+	return true, json.Unmarshal(b, v)
+}
+
+func (s *Store) PutJSON(bucket, key string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.Put(bucket, key, b)
+}